@@ -0,0 +1,64 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache is a bounded, concurrency-safe cache that evicts the least recently
+// used entry once it is full.
+type lruCache[K comparable, V any] struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+// lruEntry is an element of the recency list of an lruCache.
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// newLRUCache returns a cache holding at most size entries.
+func newLRUCache[K comparable, V any](size int) *lruCache[K, V] {
+	return &lruCache[K, V]{size: size, order: list.New(), entries: map[K]*list.Element{}}
+}
+
+// Get returns the cached value for the key, marking it as recently used.
+func (c *lruCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry[K, V]).value, true //nolint:forcetypeassert // only lruEntry values are stored
+}
+
+// Add caches the value for the key, evicting the least recently used entry if
+// the cache is full.
+func (c *lruCache[K, V]) Add(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*lruEntry[K, V]).value = value //nolint:forcetypeassert // only lruEntry values are stored
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[K, V]).key) //nolint:forcetypeassert // only lruEntry values are stored
+	}
+}
+
+// Len returns the number of cached entries.
+func (c *lruCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	xpv2 "github.com/crossplane/crossplane/apis/v2/core/v2"
+	"github.com/crossplane/function-sequencer/input/v1beta1"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/ext"
+
+	v1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/request"
+	"github.com/crossplane/function-sdk-go/resource"
+)
+
+// celStateVariable is a hidden CEL variable holding the state the helper
+// functions read. The helper macros pass it to their implementations, so that
+// the CEL environment and compiled programs do not depend on the request.
+const celStateVariable = "__sequencer"
+
+// celStateType is the CEL type of the hidden state variable.
+var celStateType = cel.OpaqueType("sequencer.fn.crossplane.io.State") //nolint:gochecknoglobals // immutable type
+
+// celState exposes the composed resources of a request to the CEL helper
+// functions. The resources are only read from the request when a helper is
+// called.
+type celState struct {
+	req    *v1.RunFunctionRequest
+	source v1beta1.ReadinessSource
+
+	once     sync.Once
+	desired  map[resource.Name]*resource.DesiredComposed
+	observed map[resource.Name]resource.ObservedComposed
+	err      error
+}
+
+func newCELState(req *v1.RunFunctionRequest, source v1beta1.ReadinessSource) *celState {
+	return &celState{req: req, source: source}
+}
+
+func (s *celState) load() error {
+	s.once.Do(func() {
+		if s.desired, s.err = request.GetDesiredComposedResources(s.req); s.err != nil {
+			s.err = errors.Wrap(s.err, "cannot get desired composed resources")
+			return
+		}
+		if s.observed, s.err = request.GetObservedComposedResources(s.req); s.err != nil {
+			s.err = errors.Wrap(s.err, "cannot get observed composed resources")
+		}
+	})
+	return s.err
+}
+
+// ConvertToNative implements ref.Val.
+func (s *celState) ConvertToNative(t reflect.Type) (any, error) {
+	return nil, errors.Errorf("cannot convert %s to %v", celStateType, t)
+}
+
+// ConvertToType implements ref.Val.
+func (s *celState) ConvertToType(t ref.Type) ref.Val {
+	if t.TypeName() == celStateType.TypeName() {
+		return s
+	}
+	return types.NewErr("cannot convert %s to %s", celStateType, t.TypeName())
+}
+
+// Equal implements ref.Val.
+func (s *celState) Equal(other ref.Val) ref.Val {
+	return types.Bool(other == s)
+}
+
+// Type implements ref.Val.
+func (s *celState) Type() ref.Type {
+	return celStateType
+}
+
+// Value implements ref.Val.
+func (s *celState) Value() any {
+	return s
+}
+
+// celHelper is a CEL function that reads the state of the request. Its
+// arguments are all strings.
+type celHelper struct {
+	name   string
+	args   []*cel.Type
+	result *cel.Type
+	fn     func(s *celState, args ...string) ref.Val
+}
+
+// celHelpers are the functions available to CEL expressions in addition to
+// the standard library and extensions.
+var celHelpers = []celHelper{ //nolint:gochecknoglobals // read-only function table
+	{
+		// isReady(name) returns true if the named composed resource is ready
+		// according to the readiness source of the input.
+		name:   "isReady",
+		args:   []*cel.Type{cel.StringType},
+		result: cel.BoolType,
+		fn: func(s *celState, args ...string) ref.Val {
+			return types.Bool(isReady(resource.Name(args[0]), s.desired, s.observed, s.source))
+		},
+	},
+	{
+		// exists(name) returns true if the named composed resource exists in
+		// the cluster.
+		name:   "exists",
+		args:   []*cel.Type{cel.StringType},
+		result: cel.BoolType,
+		fn: func(s *celState, args ...string) ref.Val {
+			_, ok := s.observed[resource.Name(args[0])]
+			return types.Bool(ok)
+		},
+	},
+	{
+		// matching(regex) returns the sorted names of the desired composed
+		// resources matching the regex.
+		name:   "matching",
+		args:   []*cel.Type{cel.StringType},
+		result: cel.ListType(cel.StringType),
+		fn: func(s *celState, args ...string) ref.Val {
+			names, err := s.matching(args[0])
+			if err != nil {
+				return types.WrapErr(err)
+			}
+			return types.DefaultTypeAdapter.NativeToValue(names)
+		},
+	},
+	{
+		// readyCount(regex) returns how many of the desired composed resources
+		// matching the regex are ready.
+		name:   "readyCount",
+		args:   []*cel.Type{cel.StringType},
+		result: cel.IntType,
+		fn: func(s *celState, args ...string) ref.Val {
+			names, err := s.matching(args[0])
+			if err != nil {
+				return types.WrapErr(err)
+			}
+			n := 0
+			for _, name := range names {
+				if isReady(resource.Name(name), s.desired, s.observed, s.source) {
+					n++
+				}
+			}
+			return types.Int(n)
+		},
+	},
+	{
+		// condition(name, type) returns the status of a condition of the named
+		// observed composed resource, or Unknown if it is not set.
+		name:   "condition",
+		args:   []*cel.Type{cel.StringType, cel.StringType},
+		result: cel.StringType,
+		fn: func(s *celState, args ...string) ref.Val {
+			o, ok := s.observed[resource.Name(args[0])]
+			if !ok {
+				return types.String("Unknown")
+			}
+			return types.String(o.Resource.GetCondition(xpv2.ConditionType(args[1])).Status)
+		},
+	},
+}
+
+// matching returns the sorted names of the desired composed resources matching
+// the regex.
+func (s *celState) matching(pattern string) ([]string, error) {
+	re, err := getStrictRegex(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot compile regex %s", pattern)
+	}
+	names := []string{}
+	for _, n := range slices.Sorted(maps.Keys(s.desired)) {
+		if re.MatchString(string(n)) {
+			names = append(names, string(n))
+		}
+	}
+	return names, nil
+}
+
+// celOptions returns the CEL extensions and helper functions. Each helper is
+// declared as a macro that passes the hidden state variable to an internal
+// function implementing it.
+func celOptions() []cel.EnvOption {
+	opts := []cel.EnvOption{
+		ext.Strings(),
+		ext.Lists(),
+		ext.Math(),
+		ext.Encoders(),
+		cel.OptionalTypes(),
+		cel.Variable(celStateVariable, celStateType),
+	}
+	for _, h := range celHelpers {
+		internal := "__" + h.name
+		opts = append(opts,
+			cel.Macros(cel.GlobalMacro(h.name, len(h.args), func(eh cel.MacroExprFactory, _ ast.Expr, args []ast.Expr) (ast.Expr, *common.Error) {
+				return eh.NewCall(internal, append([]ast.Expr{eh.NewIdent(celStateVariable)}, args...)...), nil
+			})),
+			cel.Function(internal, cel.Overload(internal+"_state", append([]*cel.Type{celStateType}, h.args...), h.result,
+				cel.FunctionBinding(func(args ...ref.Val) ref.Val {
+					s, ok := args[0].(*celState)
+					if !ok {
+						return types.NewErr("%s called without state", h.name)
+					}
+					strs := make([]string, len(args)-1)
+					for i, a := range args[1:] {
+						v, ok := a.(types.String)
+						if !ok {
+							return types.NewErr("%s called with %s argument, want string", h.name, a.Type().TypeName())
+						}
+						strs[i] = string(v)
+					}
+					if err := s.load(); err != nil {
+						return types.WrapErr(err)
+					}
+					return h.fn(s, strs...)
+				}),
+			)),
+		)
+	}
+	return opts
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"github.com/crossplane/function-sequencer/input/v1beta1"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	v1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// enforce removes the resources an earlier sequencer step withheld, as
+// published in the supplied state, from the desired state again. Resources
+// that already exist are left alone, since removing them would delete them.
+// The function only sees the desired state, not which pipeline step produced
+// it, so it cannot tell which step added a resource back.
+func (f *Function) enforce(
+	rsp *v1.RunFunctionResponse,
+	in *v1beta1.Input,
+	published *structpb.Value,
+	desiredComposed map[resource.Name]*resource.DesiredComposed,
+	observedComposed map[resource.Name]resource.ObservedComposed,
+) (*v1.RunFunctionResponse, error) {
+	state := sequencingState{}
+	if err := convertViaJSON(&state, published.AsInterface()); err != nil {
+		response.Fatal(rsp, errors.Wrapf(err, "cannot read %s context key", StateContextKey))
+		return rsp, nil
+	}
+	for _, rule := range state.Rules {
+		removed := []string{}
+		for _, n := range rule.Blocked {
+			if _, ok := desiredComposed[resource.Name(n)]; !ok {
+				continue
+			}
+			if _, ok := observedComposed[resource.Name(n)]; ok {
+				continue
+			}
+			delete(desiredComposed, resource.Name(n))
+			removed = append(removed, n)
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		msg := fmt.Sprintf("Removing resource(s) %s blocked by sequence %v that a later pipeline step added back to the desired state", strings.Join(removed, ", "), rule)
+		f.log.Debug(msg)
+		response.Warning(rsp, errors.New(msg))
+		if in.ResetCompositeReadiness {
+			rsp.Desired.Composite.Ready = v1.Ready_READY_FALSE
+		}
+	}
+	// A later pipeline step may have set the annotations meant for this
+	// function, which must not reach the cluster either.
+	removeAnnotation(desiredComposed, DependsOnAnnotation)
+	removeAnnotation(desiredComposed, WaveAnnotation)
+	rsp.Desired.Resources = nil
+	return rsp, response.SetDesiredComposedResources(rsp, desiredComposed)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"maps"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +17,9 @@ import (
 	protectionv1beta1 "github.com/crossplane/crossplane/apis/v2/protection/v1beta1"
 	"github.com/crossplane/function-sequencer/input/v1beta1"
 	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/interpreter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/structpb"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -32,45 +36,103 @@ type Function struct {
 	v1.UnimplementedFunctionRunnerServiceServer
 
 	log logging.Logger
+	// clock returns the current time. Defaults to time.Now.
+	clock func() time.Time
+	// celCostLimit is the maximum cost of evaluating a CEL expression. No
+	// limit when zero.
+	celCostLimit uint64
+	// celTimeout is how long evaluating a CEL expression may take. No timeout
+	// when zero.
+	celTimeout time.Duration
 }
 
+// now returns the current time according to the Function's clock.
+func (f *Function) now() time.Time {
+	if f.clock == nil {
+		return time.Now()
+	}
+	return f.clock()
+}
+
+const (
+	// celProgramCacheSize is the number of compiled CEL programs kept in memory.
+	celProgramCacheSize = 1024
+	// regexCacheSize is the number of compiled regexes kept in memory.
+	regexCacheSize = 4096
+	// celInterruptCheckFrequency is how many comprehension iterations are
+	// evaluated between checks for an expired evaluation timeout.
+	celInterruptCheckFrequency = 100
+)
+
+var (
+	// celPrograms caches compiled CEL programs by expression.
+	celPrograms = newLRUCache[celProgramKey, cel.Program](celProgramCacheSize) //nolint:gochecknoglobals // shared across requests
+
+	// regexes caches compiled regexes by pattern.
+	regexes = newLRUCache[string, *regexp.Regexp](regexCacheSize) //nolint:gochecknoglobals // shared across requests
+
+	celProgramCacheHits = promauto.NewCounter(prometheus.CounterOpts{ //nolint:gochecknoglobals // registered once
+		Name: "function_sequencer_cel_program_cache_hits_total",
+		Help: "Number of CEL expressions whose compiled program was found in the cache.",
+	})
+	celProgramCacheMisses = promauto.NewCounter(prometheus.CounterOpts{ //nolint:gochecknoglobals // registered once
+		Name: "function_sequencer_cel_program_cache_misses_total",
+		Help: "Number of CEL expressions that had to be compiled because they were not in the cache.",
+	})
+	regexCacheHits = promauto.NewCounter(prometheus.CounterOpts{ //nolint:gochecknoglobals // registered once
+		Name: "function_sequencer_regex_cache_hits_total",
+		Help: "Number of regexes whose compiled form was found in the cache.",
+	})
+	regexCacheMisses = promauto.NewCounter(prometheus.CounterOpts{ //nolint:gochecknoglobals // registered once
+		Name: "function_sequencer_regex_cache_misses_total",
+		Help: "Number of regexes that had to be compiled because they were not in the cache.",
+	})
+)
+
 // getCELEnv lazily initializes the shared CEL environment on first use.
 var getCELEnv = sync.OnceValues(func() (*cel.Env, error) { //nolint:gochecknoglobals // lazy singleton
-	return cel.NewEnv(
+	return cel.NewEnv(append([]cel.EnvOption{
 		cel.Types(&v1.State{}, &structpb.Struct{}),
 		cel.Variable("observed", cel.ObjectType("apiextensions.fn.proto.v1.State")),
 		cel.Variable("desired", cel.ObjectType("apiextensions.fn.proto.v1.State")),
 		cel.Variable("context", cel.ObjectType("google.protobuf.Struct")),
-	)
+		cel.Variable("self", cel.ObjectType("google.protobuf.Struct")),
+	}, celOptions()...)...)
 })
 
 // evaluateCondition evaluates a CEL expression against the function request.
-func (f *Function) evaluateCondition(req *v1.RunFunctionRequest, condition string) (bool, error) {
-	env, err := getCELEnv()
-	if err != nil {
-		return false, errors.Wrap(err, "cannot create CEL environment")
-	}
-	ast, iss := env.Parse(condition)
-	if iss.Err() != nil {
-		return false, errors.Wrap(iss.Err(), "cannot parse CEL condition")
-	}
-	checked, iss := env.Check(ast)
-	if iss.Err() != nil {
-		return false, errors.Wrap(iss.Err(), "cannot type-check CEL condition")
-	}
-	if !checked.OutputType().IsExactType(cel.BoolType) && !checked.OutputType().IsExactType(cel.DynType) {
-		return false, errors.Errorf("CEL condition must return bool, got %s", checked.OutputType())
+// The self variable is bound to the supplied resource, or to an empty object
+// when the expression is not evaluated against a particular resource. Helper
+// functions such as isReady use the supplied readiness source.
+func (f *Function) evaluateCondition(req *v1.RunFunctionRequest, source v1beta1.ReadinessSource, condition string, self *structpb.Struct) (bool, error) {
+	if self == nil {
+		self = &structpb.Struct{}
 	}
-	program, err := env.Program(checked)
+	program, err := compileCondition(condition, f.celCostLimit)
 	if err != nil {
-		return false, errors.Wrap(err, "cannot compile CEL condition")
+		return false, err
+	}
+	ctx := context.Background()
+	if f.celTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.celTimeout)
+		defer cancel()
 	}
-	result, _, err := program.Eval(map[string]any{
+	result, _, err := program.ContextEval(ctx, map[string]any{
 		"observed": req.GetObserved(),
 		"desired":  req.GetDesired(),
 		"context":  req.GetContext(),
+		"self":     self,
+
+		celStateVariable: newCELState(req, source),
 	})
-	if err != nil {
+	var cancelled interpreter.EvalCancelledError
+	switch {
+	case errors.As(err, &cancelled) && cancelled.Cause == interpreter.CostLimitExceeded:
+		return false, errors.Errorf("CEL condition exceeded the cost limit of %d", f.celCostLimit)
+	case err != nil && ctx.Err() != nil:
+		return false, errors.Errorf("CEL condition exceeded the evaluation timeout of %s", f.celTimeout)
+	case err != nil:
 		return false, errors.Wrap(err, "cannot evaluate CEL condition")
 	}
 	ret, ok := result.Value().(bool)
@@ -80,6 +142,73 @@ func (f *Function) evaluateCondition(req *v1.RunFunctionRequest, condition strin
 	return ret, nil
 }
 
+// conditionFailed applies an error policy to a CEL expression that could not
+// be evaluated. It returns the value the expression is treated as, or the
+// error if the policy is Fatal. The Warn policy reports each distinct error
+// once per response.
+func (f *Function) conditionFailed(rsp *v1.RunFunctionResponse, policy v1beta1.ErrorPolicy, err error) (bool, error) {
+	switch policy {
+	case v1beta1.ErrorPolicyTreatAsTrue:
+		f.log.Debug("Treating CEL expression as true", "error", err)
+		return true, nil
+	case v1beta1.ErrorPolicyTreatAsFalse:
+		f.log.Debug("Treating CEL expression as false", "error", err)
+		return false, nil
+	case v1beta1.ErrorPolicyWarn:
+		if !slices.ContainsFunc(rsp.GetResults(), func(r *v1.Result) bool { return r.GetMessage() == err.Error() }) {
+			response.Warning(rsp, err)
+		}
+		return false, nil
+	case v1beta1.ErrorPolicyFatal:
+	}
+	return false, err
+}
+
+// celProgramKey identifies a compiled CEL program in the cache.
+type celProgramKey struct {
+	condition string
+	costLimit uint64
+}
+
+// compileCondition returns the compiled program of a CEL expression, limited
+// to the supplied cost unless it is zero. Programs only depend on the shared
+// CEL environment, so they are cached by expression across requests.
+func compileCondition(condition string, costLimit uint64) (cel.Program, error) {
+	key := celProgramKey{condition: condition, costLimit: costLimit}
+	if program, ok := celPrograms.Get(key); ok {
+		celProgramCacheHits.Inc()
+		return program, nil
+	}
+	celProgramCacheMisses.Inc()
+	env, err := getCELEnv()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create CEL environment")
+	}
+	ast, iss := env.Parse(condition)
+	if iss.Err() != nil {
+		return nil, errors.Wrap(iss.Err(), "cannot parse CEL condition")
+	}
+	checked, iss := env.Check(ast)
+	if iss.Err() != nil {
+		return nil, errors.Wrap(iss.Err(), "cannot type-check CEL condition")
+	}
+	if !checked.OutputType().IsExactType(cel.BoolType) && !checked.OutputType().IsExactType(cel.DynType) {
+		return nil, errors.Errorf("CEL condition must return bool, got %s", checked.OutputType())
+	}
+	// Check for interruptions regularly so that a timeout also stops long
+	// running comprehensions.
+	opts := []cel.ProgramOption{cel.InterruptCheckFrequency(celInterruptCheckFrequency)}
+	if costLimit > 0 {
+		opts = append(opts, cel.CostLimit(costLimit))
+	}
+	program, err := env.Program(checked, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot compile CEL condition")
+	}
+	celPrograms.Add(key, program)
+	return program, nil
+}
+
 const (
 	// START marks the start of a regex pattern.
 	START = "^"
@@ -93,6 +222,20 @@ const (
 	ProtectionV1GroupVersion = apiextensionsv1beta1.Group + "/" + apiextensionsv1beta1.Version
 	// UsageNameSuffix is the suffix applied when generating Usage names.
 	UsageNameSuffix = "dependency"
+	// DependsOnAnnotation lets earlier pipeline steps declare the composition resource names or regexes a
+	// desired composed resource depends on, as a comma-separated list.
+	DependsOnAnnotation = "sequencer.fn.crossplane.io/depends-on"
+	// WaveAnnotation sets the sync wave of a desired composed resource.
+	WaveAnnotation = "sequencer.fn.crossplane.io/wave"
+	// ConditionTypeSequencingStalled is the composite condition set when a step times out with the SetCondition
+	// timeout policy.
+	ConditionTypeSequencingStalled = "SequencingStalled"
+	// ConditionTypeSequencingComplete is the composite condition reporting whether any desired composed resource
+	// is still being withheld until its predecessors are ready.
+	ConditionTypeSequencingComplete = "SequencingComplete"
+	// StateContextKey is the pipeline context key the sequencing plan and the resources withheld from the desired
+	// state are published under, so that later functions can react to them.
+	StateContextKey = "sequencer.fn.crossplane.io/state"
 	// V1ModeError Error when trying to protect a namespaced resource when in v1 mode.
 	V1ModeError = "cannot protect namespaced resource (kind: %s, name: %s, namespace: %s) with enableV1Mode=true. v1 usages only support cluster-scoped resources."
 )
@@ -116,6 +259,10 @@ func (f *Function) RunFunction(_ context.Context, req *v1.RunFunctionRequest) (*
 		}
 		rsp.Meta.Ttl = durationpb.New(dur)
 	}
+	if in.StatusField != "" && !strings.HasPrefix(in.StatusField, "status.") {
+		response.Fatal(rsp, errors.Errorf("statusField %q must be a field of the composite status", in.StatusField))
+		return rsp, nil
+	}
 
 	//  Get the desired composed resources from the request.
 	desiredComposed, err := request.GetDesiredComposedResources(req)
@@ -130,28 +277,148 @@ func (f *Function) RunFunction(_ context.Context, req *v1.RunFunctionRequest) (*
 		return rsp, nil
 	}
 
+	oxr, err := request.GetObservedCompositeResource(req)
+	if err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "cannot get observed composite resource"))
+		return rsp, nil
+	}
+
+	if in.Mode == v1beta1.ModeEnforce {
+		if state, ok := request.GetContextKey(req, StateContextKey); ok {
+			return f.enforce(rsp, in, state, desiredComposed, observedComposed)
+		}
+		// No earlier step published what it withheld, so sequence the
+		// resources again and report everything withheld below.
+		f.log.Debug("Sequencing again because no earlier step published its state", "key", StateContextKey)
+	}
+
 	usages := make(map[resource.Name]*resource.DesiredComposed)
+	// requeueAfter is the earliest time a step still soaking unblocks its
+	// successors or a blocking step times out, or zero if there is none.
+	var requeueAfter time.Duration
+	// stalled is true once a step with the SetCondition timeout policy has
+	// timed out.
+	stalled := false
+	// blocked lists the resources withheld from the desired state and what
+	// they are waiting on.
+	blocked := []blockedResources{}
+
+	rules := slices.Clone(in.Rules)
+	if deps := annotationDependencies(desiredComposed); len(deps) > 0 {
+		rules = append(rules, v1beta1.SequencingRule{Dependencies: deps})
+	}
+	removeAnnotation(desiredComposed, DependsOnAnnotation)
+	if in.InferFromUsages {
+		deps, cycles := inferUsageDependencies(desiredComposed, observedComposed)
+		warnInferredCycles(rsp, "Usages", cycles)
+		if len(deps) > 0 {
+			// The Usages already exist in the desired state, so the inferred rule only sequences creation.
+			rules = append(rules, v1beta1.SequencingRule{Dependencies: deps, CreateOnly: true})
+		}
+	}
+	if in.InferFromReferences {
+		deps, cycles := inferReferenceDependencies(desiredComposed, observedComposed)
+		warnInferredCycles(rsp, "references", cycles)
+		if len(deps) > 0 {
+			rules = append(rules, v1beta1.SequencingRule{Dependencies: deps})
+		}
+	}
 
-	for _, rule := range in.Rules {
-		sequence := rule.Sequence
+	sequences := make([]*sequencingGraph, len(rules))
+	for i, rule := range rules {
+		sequence, err := newSequencingGraph(rule)
+		if err != nil {
+			response.Fatal(rsp, errors.Wrap(err, "invalid sequencing rule"))
+			return rsp, nil
+		}
 
 		if rule.DeleteOnly && rule.CreateOnly {
 			response.Fatal(rsp, errors.Errorf("rule for sequence %v cannot have both deleteOnly and createOnly set to true", sequence))
 			return rsp, nil
 		}
+		if rule.PairCaptureGroups {
+			// Observed resources are included so that Usages are still
+			// generated for paired resources that are being deleted.
+			names := slices.Collect(maps.Keys(desiredComposed))
+			for n := range observedComposed {
+				if _, ok := desiredComposed[n]; !ok {
+					names = append(names, n)
+				}
+			}
+			slices.Sort(names)
+			if sequence, err = sequence.pairCaptureGroups(names); err != nil {
+				response.Fatal(rsp, errors.Wrap(err, "invalid sequencing rule"))
+				return rsp, nil
+			}
+		}
+		sequences[i] = sequence
+	}
+
+	byWave, err := syncWaves(in.Waves, desiredComposed)
+	if err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "cannot assign sync waves"))
+		return rsp, nil
+	}
+	removeAnnotation(desiredComposed, WaveAnnotation)
+	if len(byWave) > 1 {
+		waves, err := newWaveGraph(byWave)
+		if err != nil {
+			response.Fatal(rsp, errors.Wrap(err, "cannot order sync waves"))
+			return rsp, nil
+		}
+		// The waves are sequenced like a rule without settings of its own.
+		rules = append(rules, v1beta1.SequencingRule{})
+		sequences = append(sequences, waves)
+	}
+
+	// Match every pattern against the composed resources once, rather than
+	// every time a step is checked.
+	idx := newMatchIndex(desiredComposed, observedComposed)
+	if err := idx.addGraphs(sequences...); err != nil {
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+
+	// Contradicting rules would block the resources involved forever, so refuse
+	// to sequence anything until they are fixed.
+	if err := detectCycles(sequences, idx); err != nil {
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+
+	// aggregate is true when delayed resources are summarized for each rule
+	// rather than reported for each step.
+	aggregate := in.Results != nil && in.Results.Aggregation == v1beta1.ResultAggregationPerRule
+	progress := make([]ruleProgress, len(rules))
+	for ri, rule := range rules {
+		sequence, err := f.bypassSteps(req, rsp, in.ReadinessSource, sequences[ri])
+		if err != nil {
+			response.Fatal(rsp, err)
+			return rsp, nil
+		}
+		order, err := sequence.order()
+		if err != nil {
+			response.Fatal(rsp, err)
+			return rsp, nil
+		}
+		progress[ri] = ruleProgress{sequence: sequence, order: order, usages: map[resource.Name]*resource.DesiredComposed{}}
 
 		// Evaluate the optional CEL condition to determine if this sequence should be processed.
 		skipSequence := false
 		if rule.Condition != "" {
-			conditionMet, err := f.evaluateCondition(req, rule.Condition)
+			conditionMet, err := f.evaluateCondition(req, in.ReadinessSource, rule.Condition, nil)
 			if err != nil {
-				response.Fatal(rsp, errors.Wrapf(err, "cannot evaluate condition %q for sequence %v", rule.Condition, sequence))
+				conditionMet, err = f.conditionFailed(rsp, rule.OnError, errors.Wrapf(err, "cannot evaluate condition %q for sequence %v", rule.Condition, sequence))
+			}
+			if err != nil {
+				response.Fatal(rsp, err)
 				return rsp, nil
 			}
 			if !conditionMet {
 				f.log.Debug("Skipping sequence due to false condition", "condition", rule.Condition, "sequence", sequence)
 				response.Normal(rsp, fmt.Sprintf("Skipping sequence %v: condition %q evaluated to false", sequence, rule.Condition))
 				skipSequence = true
+				progress[ri].skipped = true
 			}
 		}
 
@@ -162,155 +429,337 @@ func (f *Function) RunFunction(_ context.Context, req *v1.RunFunctionRequest) (*
 		// creation-sequencing loop below only removes not-yet-observed resources from desiredComposed.
 		// CreateOnly rules skip usage generation entirely (they only enforce creation ordering).
 		if in.EnableDeletionSequencing && !rule.CreateOnly {
-			if err := f.generateObservedUsages(sequence, observedComposed, desiredComposed, usages, in.ReplayDeletion, in.UsageVersion); err != nil {
+			if err := f.generateObservedUsages(sequence, idx, progress[ri].usages, in.ReplayDeletion, in.UsageVersion); err != nil {
 				response.Fatal(rsp, errors.Wrap(err, "cannot generate usages for sequence"))
 				return rsp, err
 			}
+			maps.Copy(usages, progress[ri].usages)
 		}
 
 		if skipSequence {
 			continue
 		}
+		// delays are the resources this rule withholds.
+		delays := len(blocked)
 
-		// Creation sequencing: for each resource in the sequence (after the first),
+		// Creation sequencing: for each resource in the sequence that depends on others,
 		// check that all predecessor resources exist and are ready before allowing creation.
-		for i, r := range sequence {
-			if i == 0 {
-				// We don't need to do anything for the first resource in the sequence.
+		for _, i := range order {
+			predecessors := sequence.ancestors(i, order)
+			if len(predecessors) == 0 {
+				// We don't need to do anything for resources without predecessors.
 				continue
 			}
+			current := sequence.steps[i]
 			// Already exists in the cluster, no creation sequencing needed.
-			if _, created := observedComposed[r]; created {
-				f.log.Debug("Skipping already created resource", "r:", r)
+			if current.created(observedComposed) {
+				f.log.Debug("Skipping already created resource", "r:", current)
 				continue
 			}
 			// DeleteOnly rules only generate usages (handled above), never block creation.
 			if rule.DeleteOnly {
-				f.log.Debug("Skipping resource creation due to deleteOnly rule", "r:", r)
+				f.log.Debug("Skipping resource creation due to deleteOnly rule", "r:", current)
 				continue
 			}
 			// Check each predecessor in the sequence to see if it exists and is ready.
-			for _, before := range sequence[:i] {
-				beforeRegex, err := getStrictRegex(string(before))
+			for _, p := range predecessors {
+				waiting, soakLeft, err := f.waitingOn(req, rsp, sequence.steps[p], idx, in.ReadinessSource)
 				if err != nil {
-					response.Fatal(rsp, errors.Wrapf(err, "cannot compile regex %s", before))
+					response.Fatal(rsp, errors.Wrapf(err, "cannot check readiness for sequence %v", sequence))
 					return rsp, nil
 				}
-				// Collect all desired resources matching the predecessor pattern.
-				keys := []resource.Name{}
-				for k := range desiredComposed {
-					if beforeRegex.MatchString(string(k)) {
-						keys = append(keys, k)
-					}
+				if waiting == "" {
+					continue
+				}
+				if soakLeft > 0 && (requeueAfter == 0 || soakLeft < requeueAfter) {
+					requeueAfter = soakLeft
 				}
 
-				// We'll treat everything the same way adding all resources to the keys slice
-				// and then checking if they are ready.
-				desired := len(keys)
-				readyResources := 0
-				for _, k := range keys {
-					if d, ok := desiredComposed[k]; ok && d.Ready == resource.ReadyTrue {
-						// resource is ready, add it to the counter
-						readyResources++
+				// Predecessor not ready: delay creation by removing the current resource from desired.
+				msg := fmt.Sprintf("Delaying creation of resource(s) matching %s because %s", current, waiting)
+				blocking := sequence.steps[p]
+				timeoutLeft := time.Duration(0)
+				if blocking.timeout > 0 {
+					// The clock starts when the blocking step itself was
+					// unblocked, not when the composite was created.
+					unblocked, err := sequence.unblockedAt(p, order, idx, oxr.Resource.GetCreationTimestamp().Time)
+					if err != nil {
+						response.Fatal(rsp, err)
+						return rsp, nil
+					}
+					since, err := blocking.waitingSince(idx, unblocked)
+					if err != nil {
+						response.Fatal(rsp, err)
+						return rsp, nil
+					}
+					timeoutLeft = blocking.timeout - f.now().Sub(since)
+					if since.IsZero() {
+						// Without a start time, e.g. for a composite without a
+						// creationTimestamp, the step has not started timing out.
+						timeoutLeft = blocking.timeout
 					}
 				}
-
-				currentRegex, err := getStrictRegex(string(r))
-				if err != nil {
-					response.Fatal(rsp, errors.Wrapf(err, "cannot compile regex %s", r))
+				// delayed is true when the delay is reported as usual, rather
+				// than because of a timeout.
+				delayed := false
+				switch {
+				case blocking.timeout == 0:
+					delayed = true
+				case timeoutLeft > 0:
+					// Come back when the timeout expires so that it is acted upon in time.
+					if requeueAfter == 0 || timeoutLeft < requeueAfter {
+						requeueAfter = timeoutLeft
+					}
+					delayed = true
+				case blocking.onTimeout == v1beta1.TimeoutPolicyProceed:
+					msg = fmt.Sprintf("Proceeding with creation of resource(s) matching %s after waiting more than %s, although %s", current, blocking.timeout, waiting)
+					response.Warning(rsp, errors.New(msg))
+					f.log.Debug(msg)
+					continue
+				case blocking.onTimeout == v1beta1.TimeoutPolicyFatal:
+					response.Fatal(rsp, errors.Errorf("%s for more than %s", msg, blocking.timeout))
 					return rsp, nil
-				}
-
-				// Predecessor not ready: delay creation by removing the current resource from desired.
-				if desired == 0 || desired != readyResources {
-					// no resource created
-					msg := fmt.Sprintf("Delaying creation of resource(s) matching %q because %q does not exist yet", r, before)
-					if desired > 0 {
-						// provide a nicer message if there are resources.
-						msg = fmt.Sprintf(
-							"Delaying creation of resource(s) matching %q because %q is not fully ready (%d of %d)",
-							r,
-							before,
-							readyResources,
-							desired,
-						)
+				case blocking.onTimeout == v1beta1.TimeoutPolicySetCondition:
+					msg = fmt.Sprintf("%s for more than %s", msg, blocking.timeout)
+					response.Normal(rsp, msg)
+					if !stalled {
+						response.ConditionTrue(rsp, ConditionTypeSequencingStalled, "Timeout").WithMessage(msg).TargetComposite()
 					}
+					stalled = true
+				default:
+					msg = fmt.Sprintf("%s for more than %s", msg, blocking.timeout)
+					response.Warning(rsp, errors.New(msg))
+				}
+				if delayed && !aggregate && !slices.ContainsFunc(rsp.GetResults(), func(r *v1.Result) bool { return r.GetMessage() == msg }) {
+					// Rules sharing a step and its predecessor report the delay once.
 					response.Normal(rsp, msg)
-					f.log.Debug(msg)
-					// find all objects that match the regex and delete them from the desiredComposed map
-					for k := range desiredComposed {
-						if currentRegex.MatchString(string(k)) {
-							if _, ok := observedComposed[k]; ok {
-								// if the resource is already part of the observedComposed, we should not delete it
-								continue
-							}
-							delete(desiredComposed, k)
-							if in.ResetCompositeReadiness {
-								rsp.Desired.Composite.Ready = v1.Ready_READY_FALSE
-							}
+				}
+				f.log.Debug(msg)
+				removed := []resource.Name{}
+				for _, pattern := range current.patterns {
+					matching, err := idx.desired(pattern)
+					if err != nil {
+						response.Fatal(rsp, err)
+						return rsp, nil
+					}
+					// find all objects that match the pattern and delete them from the desiredComposed map
+					for _, k := range matching {
+						if _, ok := observedComposed[k]; ok {
+							// if the resource is already part of the observedComposed, we should not delete it
+							continue
+						}
+						delete(desiredComposed, k)
+						removed = append(removed, k)
+						if in.ResetCompositeReadiness {
+							rsp.Desired.Composite.Ready = v1.Ready_READY_FALSE
 						}
 					}
-					break
 				}
+				if len(removed) > 0 {
+					blocked = append(blocked, blockedResources{names: removed, waiting: waiting, summarize: delayed && aggregate})
+					progress[ri].blocked = append(progress[ri].blocked, removed...)
+				}
+				break
+			}
+		}
+		if aggregate {
+			summarizeDelays(rsp, sequence, in.Results, blocked[delays:])
+		}
+	}
+	if !stalled && slices.ContainsFunc(sequences, (*sequencingGraph).setsStalledCondition) {
+		// Clear a condition set by an earlier reconcile once nothing is stalled anymore.
+		response.ConditionFalse(rsp, ConditionTypeSequencingStalled, "NotStalled").TargetComposite()
+	}
+	setSequencingComplete(rsp, blocked, maxNames(in.Results))
+	if in.Mode == v1beta1.ModeEnforce {
+		// In the last pipeline step, anything withheld was added back by a
+		// step after the one that sequenced it.
+		for _, b := range blocked {
+			names := make([]string, len(b.names))
+			for i, n := range b.names {
+				names[i] = string(n)
+			}
+			response.Warning(rsp, errors.Errorf("Removing resource(s) %s that a later pipeline step added back to the desired state, because %s", strings.Join(names, ", "), b.waiting))
+		}
+	}
+	if in.StatusField != "" {
+		report := sequencingReport{Rules: make([]ruleReport, len(rules))}
+		for ri, rule := range rules {
+			r, err := f.reportRule(req, rsp, ri, rule, progress[ri], idx, in.ReadinessSource)
+			if err != nil {
+				response.Fatal(rsp, errors.Wrap(err, "cannot report sequencing progress"))
+				return rsp, nil
 			}
+			report.Rules[ri] = r
+		}
+		if err := setStatusField(rsp, in.StatusField, report); err != nil {
+			response.Fatal(rsp, err)
+			return rsp, nil
 		}
 	}
+	state := sequencingState{Rules: make([]ruleState, len(rules)), Blocked: []string{}}
+	withheld := map[string]bool{}
+	for ri, rule := range rules {
+		s, err := newRuleState(ri, rule, sequences[ri], progress[ri], idx)
+		if err != nil {
+			response.Fatal(rsp, errors.Wrap(err, "cannot publish sequencing state"))
+			return rsp, nil
+		}
+		state.Rules[ri] = s
+		for _, n := range s.Blocked {
+			withheld[n] = true
+		}
+	}
+	state.Blocked = append(state.Blocked, slices.Sorted(maps.Keys(withheld))...)
+	if err := setStateContextKey(rsp, state); err != nil {
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+	// Come back as soon as a soaking step may unblock its successors or a step
+	// times out, rather than waiting for the response to expire.
+	if requeueAfter > 0 && requeueAfter < rsp.GetMeta().GetTtl().AsDuration() {
+		rsp.Meta.Ttl = durationpb.New(requeueAfter)
+	}
 	// Merge generated usages into desired resources before returning.
 	maps.Copy(desiredComposed, usages)
 	rsp.Desired.Resources = nil
 	return rsp, response.SetDesiredComposedResources(rsp, desiredComposed)
 }
 
+// blockedResources are resources withheld from the desired state because of
+// a predecessor that is not ready.
+type blockedResources struct {
+	names []resource.Name
+	// waiting describes the predecessor they are waiting on.
+	waiting string
+	// summarize is true when the delay is reported in the summary of the
+	// rule rather than in a result of its own.
+	summarize bool
+}
+
+// setSequencingComplete sets the SequencingComplete condition of the
+// composite, listing at most maxNames of the blocked resources for each
+// predecessor they are waiting on.
+func setSequencingComplete(rsp *v1.RunFunctionResponse, blocked []blockedResources, maxNames int) {
+	if len(blocked) == 0 {
+		response.ConditionTrue(rsp, ConditionTypeSequencingComplete, "Complete").TargetComposite()
+		return
+	}
+	msgs := make([]string, len(blocked))
+	for i, b := range blocked {
+		msgs[i] = fmt.Sprintf("%s waiting because %s", listNames(b.names, maxNames), b.waiting)
+	}
+	response.ConditionFalse(rsp, ConditionTypeSequencingComplete, "WaitingOnPredecessors").
+		WithMessage(strings.Join(msgs, "; ")).
+		TargetComposite()
+}
+
+// bypassSteps removes the steps whose when condition evaluates to false from
+// the sequence.
+func (f *Function) bypassSteps(req *v1.RunFunctionRequest, rsp *v1.RunFunctionResponse, source v1beta1.ReadinessSource, sequence *sequencingGraph) (*sequencingGraph, error) {
+	bypassed := make([]bool, len(sequence.steps))
+	found := false
+	for i, s := range sequence.steps {
+		if s.when == "" {
+			continue
+		}
+		ok, err := f.evaluateCondition(req, source, s.when, nil)
+		if err != nil {
+			ok, err = f.conditionFailed(rsp, s.onError, errors.Wrapf(err, "cannot evaluate when %q for step %s of sequence %v", s.when, s, sequence))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			f.log.Debug("Bypassing step due to false condition", "when", s.when, "step", s, "sequence", sequence)
+			bypassed[i], found = true, true
+		}
+	}
+	if !found {
+		return sequence, nil
+	}
+	return sequence.without(bypassed), nil
+}
+
 // generateObservedUsages creates Usage/ClusterUsage resources for observed resources in a sequence,
-// ensuring deletion order is preserved.
+// ensuring deletion order is preserved. A Usage is generated for every direct dependency in the graph.
 func (f *Function) generateObservedUsages(
-	sequence []resource.Name,
-	observedComposed map[resource.Name]resource.ObservedComposed,
-	desiredComposed map[resource.Name]*resource.DesiredComposed,
+	sequence *sequencingGraph,
+	idx *matchIndex,
 	usages map[resource.Name]*resource.DesiredComposed,
 	replayDeletion bool,
 	usageVersion v1beta1.UsageVersion,
 ) error {
-	for i := 1; i < len(sequence); i++ {
-		rRegex, err := getStrictRegex(string(sequence[i]))
-		if err != nil {
-			return errors.Wrapf(err, "cannot compile regex %s", sequence[i])
+	for _, e := range sequence.edges() {
+		for _, by := range sequence.steps[e.to].patterns {
+			for _, of := range sequence.steps[e.from].patterns {
+				if err := f.generatePatternUsages(by, of, idx, usages, replayDeletion, usageVersion); err != nil {
+					return err
+				}
+			}
 		}
-		ofRegex, err := getStrictRegex(string(sequence[i-1]))
-		if err != nil {
-			return errors.Wrapf(err, "cannot compile regex %s", sequence[i-1])
+	}
+	return nil
+}
+
+// generatePatternUsages creates Usage/ClusterUsage resources protecting the observed resources matching the of pattern
+// from deletion while observed resources matching the by pattern exist.
+func (f *Function) generatePatternUsages(
+	by, of pattern,
+	idx *matchIndex,
+	usages map[resource.Name]*resource.DesiredComposed,
+	replayDeletion bool,
+	usageVersion v1beta1.UsageVersion,
+) error {
+	byNames, err := idx.observed(by)
+	if err != nil {
+		return err
+	}
+	ofNames, err := idx.desired(of)
+	if err != nil {
+		return err
+	}
+	for _, c := range byNames {
+		o := idx.observedComposed[c]
+		if isUsage(o, usageVersion) {
+			continue
 		}
-		for c, o := range observedComposed {
-			if !rRegex.MatchString(string(c)) || isUsage(o, usageVersion) {
-				continue
-			}
-			for k := range desiredComposed {
-				if !ofRegex.MatchString(string(k)) {
-					continue
-				}
-				if obs, ok := observedComposed[k]; ok {
-					f.log.Debug("Generate Usage for observed resource", "of:", k, "by:", c)
-					usage := GenerateUsage(&obs.Resource.Unstructured, &o.Resource.Unstructured, replayDeletion, usageVersion)
-					usageComposed := composed.New()
-					if err := convertViaJSON(usageComposed, usage); err != nil {
-						return errors.Wrapf(err, "cannot convert to JSON %s", usage)
-					}
-					usages[c+"-"+k+"-usage"] = &resource.DesiredComposed{Resource: usageComposed, Ready: resource.ReadyTrue}
+		for _, k := range ofNames {
+			if obs, ok := idx.observedComposed[k]; ok {
+				f.log.Debug("Generate Usage for observed resource", "of:", k, "by:", c)
+				usage := GenerateUsage(&obs.Resource.Unstructured, &o.Resource.Unstructured, replayDeletion, usageVersion)
+				usageComposed := composed.New()
+				if err := convertViaJSON(usageComposed, usage); err != nil {
+					return errors.Wrapf(err, "cannot convert to JSON %s", usage)
 				}
+				usages[c+"-"+k+"-usage"] = &resource.DesiredComposed{Resource: usageComposed, Ready: resource.ReadyTrue}
 			}
 		}
 	}
 	return nil
 }
 
+// getStrictRegex compiles a pattern that must match an entire name unless it
+// is already delimited. Compiled regexes are cached across requests.
 func getStrictRegex(pattern string) (*regexp.Regexp, error) {
-	if !strings.HasPrefix(pattern, START) && !strings.HasSuffix(pattern, END) {
+	if re, ok := regexes.Get(pattern); ok {
+		regexCacheHits.Inc()
+		return re, nil
+	}
+	regexCacheMisses.Inc()
+	expr := pattern
+	if !strings.HasPrefix(expr, START) && !strings.HasSuffix(expr, END) {
 		// if the user provides a delimited regex, we'll use it as is
 		// if not, add the regex with ^ & $ to match the entire string
 		// possibly avoid using regex for matching literal strings
-		pattern = fmt.Sprintf("%s%s%s", START, pattern, END)
+		expr = fmt.Sprintf("%s%s%s", START, expr, END)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
 	}
-	return regexp.Compile(pattern)
+	regexes.Add(pattern, re)
+	return re, nil
 }
 
 // GenerateUsage determines whether to return a v1 or v2 Crossplane usage.
@@ -2,15 +2,23 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/crossplane/crossplane-runtime/v2/pkg/logging"
 	"github.com/crossplane/function-sequencer/input/v1beta1"
+	"github.com/google/cel-go/cel"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"google.golang.org/protobuf/testing/protocmp"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
 
 	v1 "github.com/crossplane/function-sdk-go/proto/v1"
 	"github.com/crossplane/function-sdk-go/resource"
@@ -29,6 +37,17 @@ func TestRunFunction(t *testing.T) {
 		u2v2  = `{"apiVersion":"protection.crossplane.io/v1beta1","kind":"ClusterUsage","metadata":{"name":"mr-cool-mr-mr-cool-mr-91201d-dependency"},"spec":{"by":{"apiVersion":"example.org/v1","kind":"MR","resourceRef":{"name":"cool-mr"}},"of":{"apiVersion":"example.org/v1","kind":"MR","resourceRef":{"name":"cool-mr"}},"reason":"dependency","replayDeletion":true}}`
 		nuv2  = `{"apiVersion":"protection.crossplane.io/v1beta1","kind":"Usage","metadata":{"name":"mr-cool-mr-xr-cool-xr-d9f469-dependency","namespace":"cool-namespace"},"spec":{"by":{"apiVersion":"example.org/v1","kind":"MR","resourceRef":{"name":"cool-mr"}},"of":{"apiVersion":"example.org/v1","kind":"XR","resourceRef":{"name":"cool-xr"}},"reason":"dependency","replayDeletion":true}}`
 		nu2v2 = `{"apiVersion":"protection.crossplane.io/v1beta1","kind":"Usage","metadata":{"name":"mr-cool-mr-mr-cool-mr-91201d-dependency","namespace":"cool-namespace"},"spec":{"by":{"apiVersion":"example.org/v1","kind":"MR","resourceRef":{"name":"cool-mr"}},"of":{"apiVersion":"example.org/v1","kind":"MR","resourceRef":{"name":"cool-mr"}},"reason":"dependency","replayDeletion":true}}`
+		dbmr  = `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-db"}}`
+		appmr = `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"labels":{"app":"cool"}}}`
+		vpc   = `{"apiVersion":"example.org/v1","kind":"VPC","metadata":{"name":"cool-vpc"}}`
+		sub   = `{"apiVersion":"example.org/v1","kind":"Subnet","metadata":{"labels":{"net":"cool"}},"spec":{"forProvider":{"vpcIdRef":{"name":"cool-vpc"},"writeConnectionSecretToRef":{"name":"cool-sg"}}}}`
+		sg    = `{"apiVersion":"example.org/v1","kind":"SecurityGroup","metadata":{"name":"cool-sg"},"spec":{"forProvider":{"subnetIdSelector":{"matchLabels":{"net":"cool"}}}}}`
+		lvpc  = `{"apiVersion":"example.org/v1","kind":"VPC","metadata":{"labels":{"net":"shared"}}}`
+		lsub  = `{"apiVersion":"example.org/v1","kind":"Subnet","metadata":{"labels":{"net":"shared"}},"spec":{"forProvider":{"vpcIdSelector":{"matchLabels":{"net":"shared"}}}}}`
+		lrt   = `{"apiVersion":"example.org/v1","kind":"RouteTable","metadata":{"labels":{"net":"shared"}},"spec":{"forProvider":{"vpcIdSelector":{"matchLabels":{"net":"shared"}}}}}`
+		sga   = `{"apiVersion":"example.org/v1","kind":"SecurityGroup","metadata":{"name":"sg-a"},"spec":{"forProvider":{"sourceSecurityGroupIdRef":{"name":"sg-b"}}}}`
+		sgb   = `{"apiVersion":"example.org/v1","kind":"SecurityGroup","metadata":{"name":"sg-b"},"spec":{"forProvider":{"sourceSecurityGroupIdRef":{"name":"sg-a"}}}}`
+		uapp  = `{"apiVersion":"protection.crossplane.io/v1beta1","kind":"ClusterUsage","metadata":{"name":"app-uses-db"},"spec":{"by":{"apiVersion":"example.org/v1","kind":"MR","resourceSelector":{"matchLabels":{"app":"cool"}}},"of":{"apiVersion":"example.org/v1","kind":"MR","resourceRef":{"name":"cool-db"}}}}`
 	)
 
 	target := v1.Target_TARGET_COMPOSITE
@@ -95,7 +114,17 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"],["third"]],"released":["first","second"],"blocked":["third"],"skipped":[]}],"blocked":["third"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("third waiting because \"first\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -149,7 +178,16 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":[],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -205,7 +243,17 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first"],"blocked":["second"],"skipped":[]}],"blocked":["second"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("second waiting because \"first\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -266,6 +314,15 @@ func TestRunFunction(t *testing.T) {
 			want: want{
 				rsp: &v1.RunFunctionResponse{
 					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first","second"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{},
 					Desired: &v1.State{
 						Composite: &v1.Resource{
@@ -324,6 +381,15 @@ func TestRunFunction(t *testing.T) {
 			want: want{
 				rsp: &v1.RunFunctionResponse{
 					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first","second"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{},
 					Desired: &v1.State{
 						Composite: &v1.Resource{
@@ -392,7 +458,17 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first"],"blocked":["second"],"skipped":[]},{"index":1,"steps":[["third"],["fourth"]],"released":["third"],"blocked":["fourth"],"skipped":[]}],"blocked":["fourth","second"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("second waiting because \"first\" is not fully ready (0 of 1); fourth waiting because \"third\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -473,6 +549,15 @@ func TestRunFunction(t *testing.T) {
 			want: want{
 				rsp: &v1.RunFunctionResponse{
 					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first","second"],"blocked":[],"skipped":[]},{"index":1,"steps":[["third"],["fourth"]],"released":["fourth","third"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{},
 					Desired: &v1.State{
 						Composite: &v1.Resource{
@@ -539,7 +624,17 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first"],"blocked":["second"],"skipped":[]}],"blocked":["second"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("second waiting because \"first\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -609,7 +704,17 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first-.*"],["second"]],"released":["first-0","first-1","first-2"],"blocked":["second"],"skipped":[]}],"blocked":["second"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("second waiting because \"first-.*\" is not fully ready (2 of 3)"),
+							Target:  &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -689,7 +794,16 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first-.*"],["second-.*"]],"released":["first-1","first-2","second-1"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -772,7 +886,17 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first-.*"],["second-.*"],["third"]],"released":["first-0","first-1","first-2","second-0","second-1"],"blocked":["third"],"skipped":[]}],"blocked":["third"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("third waiting because \"second-.*\" is not fully ready (1 of 2)"),
+							Target:  &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -855,7 +979,17 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second-.*"],["third"]],"released":["first","second-0","second-1"],"blocked":["third"],"skipped":[]}],"blocked":["third"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("third waiting because \"second-.*\" is not fully ready (1 of 2)"),
+							Target:  &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -933,7 +1067,17 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first-.*"],["second$"],["third-resource"]],"released":["first-0","first-1"],"blocked":["0-second","1-second","third-resource"],"skipped":[]}],"blocked":["0-second","1-second","third-resource"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("0-second, 1-second waiting because \"first-.*\" is not fully ready (1 of 2); third-resource waiting because \"first-.*\" is not fully ready (1 of 2)"),
+							Target:  &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -1012,7 +1156,16 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["^first-.*$"],["^second-.*"],["third-.*$"],["fourth"]],"released":["first-0","first-1","second-0","third-0"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -1170,6 +1323,15 @@ func TestRunFunction(t *testing.T) {
 			want: want{
 				rsp: &v1.RunFunctionResponse{
 					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first","second"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{},
 					Desired: &v1.State{
 						Composite: &v1.Resource{
@@ -1245,6 +1407,15 @@ func TestRunFunction(t *testing.T) {
 			want: want{
 				rsp: &v1.RunFunctionResponse{
 					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first","second"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{},
 					Desired: &v1.State{
 						Composite: &v1.Resource{
@@ -1320,6 +1491,15 @@ func TestRunFunction(t *testing.T) {
 			want: want{
 				rsp: &v1.RunFunctionResponse{
 					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first","second"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{},
 					Desired: &v1.State{
 						Composite: &v1.Resource{
@@ -1412,6 +1592,15 @@ func TestRunFunction(t *testing.T) {
 			want: want{
 				rsp: &v1.RunFunctionResponse{
 					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second-.*"],["third"]],"released":["first","second-0","second-1","third"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{},
 					Desired: &v1.State{
 						Composite: &v1.Resource{
@@ -1524,6 +1713,15 @@ func TestRunFunction(t *testing.T) {
 			want: want{
 				rsp: &v1.RunFunctionResponse{
 					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"],["third-.*"]],"released":["first","second","third-0","third-1"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{},
 					Desired: &v1.State{
 						Composite: &v1.Resource{
@@ -1632,6 +1830,15 @@ func TestRunFunction(t *testing.T) {
 			want: want{
 				rsp: &v1.RunFunctionResponse{
 					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second-.*"],["third"]],"released":["first","second-0","second-1","third"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{},
 					Desired: &v1.State{
 						Composite: &v1.Resource{
@@ -1744,6 +1951,15 @@ func TestRunFunction(t *testing.T) {
 			want: want{
 				rsp: &v1.RunFunctionResponse{
 					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second-.*"],["third"]],"released":["first","second-0","second-1","third"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{},
 					Desired: &v1.State{
 						Composite: &v1.Resource{
@@ -1834,6 +2050,15 @@ func TestRunFunction(t *testing.T) {
 			want: want{
 				rsp: &v1.RunFunctionResponse{
 					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first-.*"],["second-.*"]],"released":["first-foo","second-foo"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{},
 					Desired: &v1.State{
 						Composite: &v1.Resource{
@@ -1902,7 +2127,17 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"],["third"]],"released":["first","second"],"blocked":["third"],"skipped":[]}],"blocked":["third"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("third waiting because \"first\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -1965,7 +2200,17 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first"],"blocked":["second"],"skipped":[]}],"blocked":["second"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("second waiting because \"first\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -2024,7 +2269,17 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first"],"blocked":["second"],"skipped":[]}],"blocked":["second"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("second waiting because \"first\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -2083,7 +2338,16 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":[],"blocked":[],"skipped":["first","second"]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -2146,7 +2410,16 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":[],"blocked":[],"skipped":["first","second"]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -2208,7 +2481,17 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first"],"blocked":["second"],"skipped":[]}],"blocked":["second"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("second waiting because \"first\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -2278,7 +2561,16 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":[],"blocked":[],"skipped":["first","second"]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -2348,7 +2640,16 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":[],"blocked":[],"skipped":["first","second"]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -2420,7 +2721,16 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":[],"blocked":[],"skipped":["first","second"]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Results: []*v1.Result{
 						{
 							Severity: v1.Severity_SEVERITY_NORMAL,
@@ -2485,7 +2795,16 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first","second"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Desired: &v1.State{
 						Composite: &v1.Resource{
 							Resource: resource.MustStructJSON(xr),
@@ -2534,7 +2853,16 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first","second"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Desired: &v1.State{
 						Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
 						Resources: map[string]*v1.Resource{
@@ -2640,7 +2968,16 @@ func TestRunFunction(t *testing.T) {
 			},
 			want: want{
 				rsp: &v1.RunFunctionResponse{
-					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":["first","second"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
 					Desired: &v1.State{
 						Composite: &v1.Resource{
 							Resource: resource.MustStructJSON(xr),
@@ -2663,173 +3000,3503 @@ func TestRunFunction(t *testing.T) {
 				},
 			},
 		},
-	}
-
-	for name, tc := range cases {
-		t.Run(name, func(t *testing.T) {
-			f := &Function{log: logging.NewNopLogger()}
-			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
-
-			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
-				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
-			}
-
-			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
-				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
-			}
-		})
-	}
-}
-
-func TestRunFunctionCacheTTL(t *testing.T) {
-	target := v1.Target_TARGET_COMPOSITE
-	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":1}}`
-
-	cases := map[string]struct {
-		reason string
-		input  *v1beta1.Input
-		want   *v1.RunFunctionResponse
-	}{
-		"ValidCacheTTL": {
-			reason: "The function should override the response TTL when cacheTTL is provided",
-			input: &v1beta1.Input{
-				CacheTTL: "5m",
-				Rules: []v1beta1.SequencingRule{
-					{Sequence: []resource.Name{"first", "second"}},
-				},
-			},
-			want: &v1.RunFunctionResponse{
-				Meta: &v1.ResponseMeta{Ttl: durationpb.New(5 * time.Minute)},
-				Results: []*v1.Result{
-					{
-						Severity: v1.Severity_SEVERITY_NORMAL,
-						Message:  "Delaying creation of resource(s) matching \"second\" because \"first\" does not exist yet",
-						Target:   &target,
+		"DependenciesWaitOnDirectPredecessors": {
+			reason: "A resource in a dependency graph should only wait for the resources it depends on",
+			args: args{
+				req: &v1.RunFunctionRequest{
+					Input: resource.MustStructObject(&v1beta1.Input{
+						Rules: []v1beta1.SequencingRule{
+							{
+								Dependencies: []v1beta1.Dependency{
+									{SequenceStep: v1beta1.SequenceStep{Resource: "c"}, DependsOn: []resource.Name{"a", "b"}},
+									{SequenceStep: v1beta1.SequenceStep{Resource: "d"}, DependsOn: []resource.Name{"a"}},
+								},
+							},
+						},
+					}),
+					Observed: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{},
 					},
-				},
-				Desired: &v1.State{
-					Composite: &v1.Resource{
-						Resource: resource.MustStructJSON(xr),
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"a": {
+								Resource: resource.MustStructJSON(mr),
+								Ready:    v1.Ready_READY_TRUE,
+							},
+							"b": {
+								Resource: resource.MustStructJSON(mr),
+							},
+							"c": {
+								Resource: resource.MustStructJSON(mr),
+							},
+							"d": {
+								Resource: resource.MustStructJSON(mr),
+							},
+						},
 					},
-					Resources: map[string]*v1.Resource{},
-				},
-			},
-		},
-		"InvalidCacheTTL": {
-			reason: "The function should return a fatal result when cacheTTL cannot be parsed",
-			input: &v1beta1.Input{
-				CacheTTL: "5x",
-				Rules: []v1beta1.SequencingRule{
-					{Sequence: []resource.Name{"first", "second"}},
 				},
 			},
-			want: &v1.RunFunctionResponse{
-				Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
-				Results: []*v1.Result{
-					{
-						Severity: v1.Severity_SEVERITY_FATAL,
-						Message:  "cannot set cacheTTL: time: unknown unit \"x\" in duration \"5x\"",
-						Target:   &target,
-					},
-				},
-				Desired: &v1.State{
-					Composite: &v1.Resource{
-						Resource: resource.MustStructJSON(xr),
+			want: want{
+				rsp: &v1.RunFunctionResponse{
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["a"],["b"],["c"],["d"]],"released":["a","b","d"],"blocked":["c"],"skipped":[]}],"blocked":["c"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("c waiting because \"b\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
 					},
-					Resources: map[string]*v1.Resource{
-						"second": {
-							Resource: resource.MustStructJSON(xr),
+					Results: []*v1.Result{
+						{
+							Severity: v1.Severity_SEVERITY_NORMAL,
+							Message:  "Delaying creation of resource(s) matching \"c\" because \"b\" is not fully ready (0 of 1)",
+							Target:   &target,
 						},
 					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"a": {
+								Resource: resource.MustStructJSON(mr),
+								Ready:    v1.Ready_READY_TRUE,
+							},
+							"b": {
+								Resource: resource.MustStructJSON(mr),
+							},
+							"d": {
+								Resource: resource.MustStructJSON(mr),
+							},
+						},
+					},
+				},
+			},
+		},
+		"DependenciesWaitOnTransitivePredecessors": {
+			reason: "A resource in a dependency graph should wait for the dependencies of its dependencies, regardless of declaration order",
+			args: args{
+				req: &v1.RunFunctionRequest{
+					Input: resource.MustStructObject(&v1beta1.Input{
+						Rules: []v1beta1.SequencingRule{
+							{
+								Dependencies: []v1beta1.Dependency{
+									{SequenceStep: v1beta1.SequenceStep{Resource: "c"}, DependsOn: []resource.Name{"b"}},
+									{SequenceStep: v1beta1.SequenceStep{Resource: "b"}, DependsOn: []resource.Name{"a"}},
+								},
+							},
+						},
+					}),
+					Observed: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"b": {
+								Resource: resource.MustStructJSON(mr),
+							},
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"a": {
+								Resource: resource.MustStructJSON(mr),
+							},
+							"b": {
+								Resource: resource.MustStructJSON(mr),
+								Ready:    v1.Ready_READY_TRUE,
+							},
+							"c": {
+								Resource: resource.MustStructJSON(mr),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &v1.RunFunctionResponse{
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["a"],["b"],["c"]],"released":["a","b"],"blocked":["c"],"skipped":[]}],"blocked":["c"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("c waiting because \"a\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
+					},
+					Results: []*v1.Result{
+						{
+							Severity: v1.Severity_SEVERITY_NORMAL,
+							Message:  "Delaying creation of resource(s) matching \"c\" because \"a\" is not fully ready (0 of 1)",
+							Target:   &target,
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"a": {
+								Resource: resource.MustStructJSON(mr),
+							},
+							"b": {
+								Resource: resource.MustStructJSON(mr),
+								Ready:    v1.Ready_READY_TRUE,
+							},
+						},
+					},
+				},
+			},
+		},
+		"DependenciesGenerateUsagesForEveryEdge": {
+			reason: "Deletion sequencing should generate a Usage for every direct dependency in the graph",
+			args: args{
+				req: &v1.RunFunctionRequest{
+					Input: resource.MustStructObject(&v1beta1.Input{
+						EnableDeletionSequencing: true,
+						ReplayDeletion:           true,
+						Rules: []v1beta1.SequencingRule{
+							{
+								Dependencies: []v1beta1.Dependency{
+									{SequenceStep: v1beta1.SequenceStep{Resource: "c"}, DependsOn: []resource.Name{"a", "b"}},
+									{SequenceStep: v1beta1.SequenceStep{Resource: "d"}, DependsOn: []resource.Name{"a"}},
+								},
+							},
+						},
+					}),
+					Observed: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"a": {Resource: resource.MustStructJSON(mr)},
+							"b": {Resource: resource.MustStructJSON(mr)},
+							"c": {Resource: resource.MustStructJSON(mr)},
+							"d": {Resource: resource.MustStructJSON(mr)},
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"a": {Resource: resource.MustStructJSON(mr), Ready: v1.Ready_READY_TRUE},
+							"b": {Resource: resource.MustStructJSON(mr), Ready: v1.Ready_READY_TRUE},
+							"c": {Resource: resource.MustStructJSON(mr), Ready: v1.Ready_READY_TRUE},
+							"d": {Resource: resource.MustStructJSON(mr), Ready: v1.Ready_READY_TRUE},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &v1.RunFunctionResponse{
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["a"],["b"],["c"],["d"]],"released":["a","b","c","d"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"a":         {Resource: resource.MustStructJSON(mr), Ready: v1.Ready_READY_TRUE},
+							"b":         {Resource: resource.MustStructJSON(mr), Ready: v1.Ready_READY_TRUE},
+							"c":         {Resource: resource.MustStructJSON(mr), Ready: v1.Ready_READY_TRUE},
+							"d":         {Resource: resource.MustStructJSON(mr), Ready: v1.Ready_READY_TRUE},
+							"c-a-usage": {Resource: resource.MustStructJSON(u2v2), Ready: v1.Ready_READY_TRUE},
+							"c-b-usage": {Resource: resource.MustStructJSON(u2v2), Ready: v1.Ready_READY_TRUE},
+							"d-a-usage": {Resource: resource.MustStructJSON(u2v2), Ready: v1.Ready_READY_TRUE},
+						},
+					},
+				},
+			},
+		},
+		"DependenciesAndSequenceMutuallyExclusive": {
+			reason: "A rule cannot set more than one of sequence, steps and dependencies",
+			args: args{
+				req: &v1.RunFunctionRequest{
+					Input: resource.MustStructObject(&v1beta1.Input{
+						Rules: []v1beta1.SequencingRule{
+							{
+								Sequence: []resource.Name{"a", "b"},
+								Dependencies: []v1beta1.Dependency{
+									{SequenceStep: v1beta1.SequenceStep{Resource: "c"}, DependsOn: []resource.Name{"a"}},
+								},
+							},
+						},
+					}),
+					Observed: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &v1.RunFunctionResponse{
+					Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*v1.Result{
+						{
+							Severity: v1.Severity_SEVERITY_FATAL,
+							Message:  "invalid sequencing rule: sequence, steps and dependencies are mutually exclusive",
+							Target:   &target,
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"InferFromUsagesDelaysUser": {
+			reason: "The function should delay the resource a Usage is by until the resource it is of is ready",
+			args: args{
+				req: &v1.RunFunctionRequest{
+					Input: resource.MustStructObject(&v1beta1.Input{
+						InferFromUsages: true,
+					}),
+					Observed: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"db": {
+								Resource: resource.MustStructJSON(dbmr),
+							},
+							"app": {
+								Resource: resource.MustStructJSON(appmr),
+							},
+							"usage": {
+								Resource: resource.MustStructJSON(uapp),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &v1.RunFunctionResponse{
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["db"],["app"]],"released":["db"],"blocked":["app"],"skipped":[]}],"blocked":["app"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("app waiting because \"db\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
+					},
+					Results: []*v1.Result{
+						{
+							Severity: v1.Severity_SEVERITY_NORMAL,
+							Message:  "Delaying creation of resource(s) matching \"app\" because \"db\" is not fully ready (0 of 1)",
+							Target:   &target,
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"db": {
+								Resource: resource.MustStructJSON(dbmr),
+							},
+							"usage": {
+								Resource: resource.MustStructJSON(uapp),
+							},
+						},
+					},
+				},
+			},
+		},
+		"InferFromUsagesMatchesObservedNames": {
+			reason: "The function should map Usage references to composition resource names using the observed resource names",
+			args: args{
+				req: &v1.RunFunctionRequest{
+					Input: resource.MustStructObject(&v1beta1.Input{
+						InferFromUsages: true,
+					}),
+					Observed: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"db": {
+								Resource: resource.MustStructJSON(dbmr),
+							},
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"db": {
+								Resource: resource.MustStructJSON(mr),
+								Ready:    v1.Ready_READY_TRUE,
+							},
+							"app": {
+								Resource: resource.MustStructJSON(appmr),
+							},
+							"usage": {
+								Resource: resource.MustStructJSON(uapp),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &v1.RunFunctionResponse{
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["db"],["app"]],"released":["app","db"],"blocked":[],"skipped":[]}],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"db": {
+								Resource: resource.MustStructJSON(mr),
+								Ready:    v1.Ready_READY_TRUE,
+							},
+							"app": {
+								Resource: resource.MustStructJSON(appmr),
+							},
+							"usage": {
+								Resource: resource.MustStructJSON(uapp),
+							},
+						},
+					},
+				},
+			},
+		},
+		"InferFromUsagesDisabled": {
+			reason: "The function should ignore Usages in the desired state unless inferFromUsages is set",
+			args: args{
+				req: &v1.RunFunctionRequest{
+					Input: resource.MustStructObject(&v1beta1.Input{}),
+					Observed: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"db": {
+								Resource: resource.MustStructJSON(dbmr),
+							},
+							"app": {
+								Resource: resource.MustStructJSON(appmr),
+							},
+							"usage": {
+								Resource: resource.MustStructJSON(uapp),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &v1.RunFunctionResponse{
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"db": {
+								Resource: resource.MustStructJSON(dbmr),
+							},
+							"app": {
+								Resource: resource.MustStructJSON(appmr),
+							},
+							"usage": {
+								Resource: resource.MustStructJSON(uapp),
+							},
+						},
+					},
+				},
+			},
+		},
+		"InferFromReferencesDelaysReferencingResources": {
+			reason: "The function should delay resources until the resources they reference by name or selector are ready",
+			args: args{
+				req: &v1.RunFunctionRequest{
+					Input: resource.MustStructObject(&v1beta1.Input{
+						InferFromReferences: true,
+					}),
+					Observed: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"vpc": {
+								Resource: resource.MustStructJSON(vpc),
+							},
+							"subnet": {
+								Resource: resource.MustStructJSON(sub),
+							},
+							"sg": {
+								Resource: resource.MustStructJSON(sg),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &v1.RunFunctionResponse{
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["vpc"],["subnet"],["sg"]],"released":["vpc"],"blocked":["sg","subnet"],"skipped":[]}],"blocked":["sg","subnet"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("subnet waiting because \"vpc\" is not fully ready (0 of 1); sg waiting because \"vpc\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
+					},
+					Results: []*v1.Result{
+						{
+							Severity: v1.Severity_SEVERITY_NORMAL,
+							Message:  "Delaying creation of resource(s) matching \"subnet\" because \"vpc\" is not fully ready (0 of 1)",
+							Target:   &target,
+						},
+						{
+							Severity: v1.Severity_SEVERITY_NORMAL,
+							Message:  "Delaying creation of resource(s) matching \"sg\" because \"vpc\" is not fully ready (0 of 1)",
+							Target:   &target,
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"vpc": {
+								Resource: resource.MustStructJSON(vpc),
+							},
+						},
+					},
+				},
+			},
+		},
+		"InferFromReferencesReleasesWhenReady": {
+			reason: "The function should release referencing resources once the referenced resources are ready",
+			args: args{
+				req: &v1.RunFunctionRequest{
+					Input: resource.MustStructObject(&v1beta1.Input{
+						InferFromReferences: true,
+					}),
+					Observed: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"vpc": {
+								Resource: resource.MustStructJSON(vpc),
+								Ready:    v1.Ready_READY_TRUE,
+							},
+							"subnet": {
+								Resource: resource.MustStructJSON(sub),
+							},
+							"sg": {
+								Resource: resource.MustStructJSON(sg),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &v1.RunFunctionResponse{
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["vpc"],["subnet"],["sg"]],"released":["subnet","vpc"],"blocked":["sg"],"skipped":[]}],"blocked":["sg"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("sg waiting because \"subnet\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
+					},
+					Results: []*v1.Result{
+						{
+							Severity: v1.Severity_SEVERITY_NORMAL,
+							Message:  "Delaying creation of resource(s) matching \"sg\" because \"subnet\" is not fully ready (0 of 1)",
+							Target:   &target,
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"vpc": {
+								Resource: resource.MustStructJSON(vpc),
+								Ready:    v1.Ready_READY_TRUE,
+							},
+							"subnet": {
+								Resource: resource.MustStructJSON(sub),
+							},
+						},
+					},
+				},
+			},
+		},
+		"InferFromReferencesNarrowsByKind": {
+			reason: "Selectors should only match resources of the kind named by the selector field, even when other resources share the labels",
+			args: args{
+				req: &v1.RunFunctionRequest{
+					Input: resource.MustStructObject(&v1beta1.Input{
+						InferFromReferences: true,
+					}),
+					Observed: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"vpc": {
+								Resource: resource.MustStructJSON(lvpc),
+							},
+							"subnet": {
+								Resource: resource.MustStructJSON(lsub),
+							},
+							"rt": {
+								Resource: resource.MustStructJSON(lrt),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &v1.RunFunctionResponse{
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["vpc"],["rt"],["subnet"]],"released":["vpc"],"blocked":["rt","subnet"],"skipped":[]}],"blocked":["rt","subnet"]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:    ConditionTypeSequencingComplete,
+							Status:  v1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "WaitingOnPredecessors",
+							Message: ptr.To("rt waiting because \"vpc\" is not fully ready (0 of 1); subnet waiting because \"vpc\" is not fully ready (0 of 1)"),
+							Target:  &target,
+						},
+					},
+					Results: []*v1.Result{
+						{
+							Severity: v1.Severity_SEVERITY_NORMAL,
+							Message:  "Delaying creation of resource(s) matching \"rt\" because \"vpc\" is not fully ready (0 of 1)",
+							Target:   &target,
+						},
+						{
+							Severity: v1.Severity_SEVERITY_NORMAL,
+							Message:  "Delaying creation of resource(s) matching \"subnet\" because \"vpc\" is not fully ready (0 of 1)",
+							Target:   &target,
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"vpc": {
+								Resource: resource.MustStructJSON(lvpc),
+							},
+						},
+					},
+				},
+			},
+		},
+		"InferFromReferencesDropsMutualReferences": {
+			reason: "Resources referencing each other should not be sequenced and the dropped dependencies should be reported as a Warning",
+			args: args{
+				req: &v1.RunFunctionRequest{
+					Input: resource.MustStructObject(&v1beta1.Input{
+						InferFromReferences: true,
+					}),
+					Observed: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"sg-a": {
+								Resource: resource.MustStructJSON(sga),
+							},
+							"sg-b": {
+								Resource: resource.MustStructJSON(sgb),
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &v1.RunFunctionResponse{
+					Meta:    &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[],"blocked":[]}}`),
+					Conditions: []*v1.Condition{
+						{
+							Type:   ConditionTypeSequencingComplete,
+							Status: v1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Complete",
+							Target: &target,
+						},
+					},
+					Results: []*v1.Result{
+						{
+							Severity: v1.Severity_SEVERITY_WARNING,
+							Message:  "Ignoring dependencies inferred from references between resources sg-a, sg-b, because they depend on each other",
+							Target:   &target,
+						},
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*v1.Resource{
+							"sg-a": {
+								Resource: resource.MustStructJSON(sga),
+							},
+							"sg-b": {
+								Resource: resource.MustStructJSON(sgb),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionCacheTTL(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":1}}`
+
+	cases := map[string]struct {
+		reason string
+		input  *v1beta1.Input
+		want   *v1.RunFunctionResponse
+	}{
+		"ValidCacheTTL": {
+			reason: "The function should override the response TTL when cacheTTL is provided",
+			input: &v1beta1.Input{
+				CacheTTL: "5m",
+				Rules: []v1beta1.SequencingRule{
+					{Sequence: []resource.Name{"first", "second"}},
+				},
+			},
+			want: &v1.RunFunctionResponse{
+				Meta:    &v1.ResponseMeta{Ttl: durationpb.New(5 * time.Minute)},
+				Context: resource.MustStructJSON(`{"sequencer.fn.crossplane.io/state":{"rules":[{"index":0,"steps":[["first"],["second"]],"released":[],"blocked":["second"],"skipped":[]}],"blocked":["second"]}}`),
+				Conditions: []*v1.Condition{
+					{
+						Type:    ConditionTypeSequencingComplete,
+						Status:  v1.Status_STATUS_CONDITION_FALSE,
+						Reason:  "WaitingOnPredecessors",
+						Message: ptr.To(`second waiting because "first" does not exist yet`),
+						Target:  &target,
+					},
+				},
+				Results: []*v1.Result{
+					{
+						Severity: v1.Severity_SEVERITY_NORMAL,
+						Message:  "Delaying creation of resource(s) matching \"second\" because \"first\" does not exist yet",
+						Target:   &target,
+					},
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{
+						Resource: resource.MustStructJSON(xr),
+					},
+					Resources: map[string]*v1.Resource{},
+				},
+			},
+		},
+		"InvalidCacheTTL": {
+			reason: "The function should return a fatal result when cacheTTL cannot be parsed",
+			input: &v1beta1.Input{
+				CacheTTL: "5x",
+				Rules: []v1beta1.SequencingRule{
+					{Sequence: []resource.Name{"first", "second"}},
+				},
+			},
+			want: &v1.RunFunctionResponse{
+				Meta: &v1.ResponseMeta{Ttl: durationpb.New(response.DefaultTTL)},
+				Results: []*v1.Result{
+					{
+						Severity: v1.Severity_SEVERITY_FATAL,
+						Message:  "cannot set cacheTTL: time: unknown unit \"x\" in duration \"5x\"",
+						Target:   &target,
+					},
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{
+						Resource: resource.MustStructJSON(xr),
+					},
+					Resources: map[string]*v1.Resource{
+						"second": {
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(tc.input),
+				Observed: &v1.State{
+					Composite: &v1.Resource{
+						Resource: resource.MustStructJSON(xr),
+					},
+					Resources: map[string]*v1.Resource{},
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{
+						Resource: resource.MustStructJSON(xr),
+					},
+					Resources: map[string]*v1.Resource{
+						"second": {
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if diff := cmp.Diff(tc.want, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(nil, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionConditionErrors(t *testing.T) {
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+	mr := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"}}`
+
+	cases := map[string]struct {
+		reason    string
+		condition string
+	}{
+		"InvalidExpression": {
+			reason:    "Invalid CEL syntax should produce Fatal",
+			condition: `invalid $$$ expression`,
+		},
+		"NonBoolResult": {
+			reason:    "CEL expression returning non-bool should produce Fatal",
+			condition: `observed.composite.resource.spec.count`,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					Rules: []v1beta1.SequencingRule{
+						{
+							Sequence:  []resource.Name{"first", "second"},
+							Condition: tc.condition,
+						},
+					},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: map[string]*v1.Resource{},
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: map[string]*v1.Resource{
+						"first":  {Resource: resource.MustStructJSON(mr)},
+						"second": {Resource: resource.MustStructJSON(mr)},
+					},
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(rsp.GetResults()) == 0 {
+				t.Fatal("expected at least one result")
+			}
+			if rsp.GetResults()[0].GetSeverity() != v1.Severity_SEVERITY_FATAL {
+				t.Errorf("%s: expected FATAL severity, got %s", tc.reason, rsp.GetResults()[0].GetSeverity())
+			}
+		})
+	}
+}
+
+func TestRunFunctionCycles(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+	mr := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"}}`
+
+	cases := map[string]struct {
+		reason  string
+		rules   []v1beta1.SequencingRule
+		desired []string
+		want    string
+	}{
+		"ContradictingRules": {
+			reason: "Rules ordering the same resources in opposite directions should produce a Fatal result naming the cycle",
+			rules: []v1beta1.SequencingRule{
+				{Sequence: []resource.Name{"a", "b"}},
+				{Sequence: []resource.Name{"b", "a"}},
+			},
+			desired: []string{"a", "b"},
+			want:    "sequencing rules contain a cycle: a -> b -> a",
+		},
+		"CycleAcrossSequenceAndDependencies": {
+			reason: "Cycles should be detected across sequences and dependency graphs",
+			rules: []v1beta1.SequencingRule{
+				{Sequence: []resource.Name{"a", "b", "c"}},
+				{Dependencies: []v1beta1.Dependency{{SequenceStep: v1beta1.SequenceStep{Resource: "a"}, DependsOn: []resource.Name{"c"}}}},
+			},
+			want: "sequencing rules contain a cycle: a -> b -> c -> a",
+		},
+		"CycleAfterRegexExpansion": {
+			reason: "Cycles that only appear once regexes are matched against desired resources should be detected",
+			rules: []v1beta1.SequencingRule{
+				{Sequence: []resource.Name{"a-.*", "b"}},
+				{Sequence: []resource.Name{"b", "a-1"}},
+			},
+			desired: []string{"a-1", "b"},
+			want:    "sequencing rules contain a cycle between desired resources: a-1 -> b -> a-1",
+		},
+		"SelfDependencyAfterRegexExpansion": {
+			reason: "A resource matching both a step and its predecessor would wait for itself forever",
+			rules: []v1beta1.SequencingRule{
+				{Sequence: []resource.Name{"a-.*", "a-1"}},
+			},
+			desired: []string{"a-1"},
+			want:    "sequencing rules contain a cycle between desired resources: a-1 -> a-1",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			resources := map[string]*v1.Resource{}
+			for _, n := range tc.desired {
+				resources[n] = &v1.Resource{Resource: resource.MustStructJSON(mr)}
+			}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{Rules: tc.rules}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: resources,
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			want := []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_FATAL,
+					Message:  tc.want,
+					Target:   &target,
+				},
+			}
+			if diff := cmp.Diff(want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(req.GetDesired().GetResources(), rsp.GetDesired().GetResources(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): desired resources should be unchanged, -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionReadinessSource(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+	mr := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"}}`
+	readyMR := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"},"status":{"conditions":[{"type":"Ready","status":"True","reason":"Available"},{"type":"Synced","status":"True","reason":"ReconcileSuccess"}]}}`
+	unsyncedMR := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"},"status":{"conditions":[{"type":"Ready","status":"True","reason":"Available"},{"type":"Synced","status":"False","reason":"ReconcileError"}]}}`
+	delayed := &v1.Result{
+		Severity: v1.Severity_SEVERITY_NORMAL,
+		Message:  "Delaying creation of resource(s) matching \"second\" because \"first\" is not fully ready (0 of 1)",
+		Target:   &target,
+	}
+
+	cases := map[string]struct {
+		reason       string
+		source       v1beta1.ReadinessSource
+		observed     string
+		desiredReady v1.Ready
+		wantResults  []*v1.Result
+		wantCreated  bool
+	}{
+		"DesiredIgnoresObservedConditions": {
+			reason:      "The default readiness source should only consider the desired readiness",
+			observed:    readyMR,
+			wantResults: []*v1.Result{delayed},
+		},
+		"ObservedReadyReleasesSuccessor": {
+			reason:      "An observed Ready condition should release successors without a desired readiness",
+			source:      v1beta1.ReadinessSourceObserved,
+			observed:    readyMR,
+			wantCreated: true,
+		},
+		"ObservedWithoutConditionsIsNotReady": {
+			reason:       "An observed resource without a Ready condition should not be ready, even if marked ready in the desired state",
+			source:       v1beta1.ReadinessSourceObserved,
+			observed:     mr,
+			desiredReady: v1.Ready_READY_TRUE,
+			wantResults:  []*v1.Result{delayed},
+		},
+		"ObservedNotSyncedIsNotReady": {
+			reason:      "An observed resource that fails to sync should not be ready",
+			source:      v1beta1.ReadinessSourceObserved,
+			observed:    unsyncedMR,
+			wantResults: []*v1.Result{delayed},
+		},
+		"BothRequiresDesiredReadiness": {
+			reason:      "Both sources must report ready when using the Both readiness source",
+			source:      v1beta1.ReadinessSourceBoth,
+			observed:    readyMR,
+			wantResults: []*v1.Result{delayed},
+		},
+		"BothReady": {
+			reason:       "A resource ready according to both sources should release successors",
+			source:       v1beta1.ReadinessSourceBoth,
+			observed:     readyMR,
+			desiredReady: v1.Ready_READY_TRUE,
+			wantCreated:  true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					ReadinessSource: tc.source,
+					Rules: []v1beta1.SequencingRule{
+						{Sequence: []resource.Name{"first", "second"}},
+					},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: map[string]*v1.Resource{
+						"first": {Resource: resource.MustStructJSON(tc.observed)},
+					},
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: map[string]*v1.Resource{
+						"first":  {Resource: resource.MustStructJSON(mr), Ready: tc.desiredReady},
+						"second": {Resource: resource.MustStructJSON(mr)},
+					},
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			if _, created := rsp.GetDesired().GetResources()["second"]; created != tc.wantCreated {
+				t.Errorf("%s\nf.RunFunction(...): want second created %t, got %t", tc.reason, tc.wantCreated, created)
+			}
+		})
+	}
+}
+
+func TestRunFunctionReadyWhen(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+	mr := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"}}`
+	pending := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-db"},"status":{"atProvider":{}}}`
+	available := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-db"},"status":{"atProvider":{"endpoint":"db.example.org"}}}`
+
+	cases := map[string]struct {
+		reason      string
+		readyWhen   string
+		observed    map[string]string
+		wantResults []*v1.Result
+		wantCreated bool
+	}{
+		"ExpressionFalseDelaysSuccessor": {
+			reason:    "A ready predecessor should still block its successors while readyWhen is false",
+			readyWhen: `has(self.status.atProvider.endpoint) && self.status.atProvider.endpoint != ""`,
+			observed:  map[string]string{"db": pending},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  "Delaying creation of resource(s) matching \"app\" because \"db\" is not fully ready (0 of 1)",
+					Target:   &target,
+				},
+			},
+		},
+		"ExpressionTrueReleasesSuccessor": {
+			reason:      "Successors should be created once readyWhen is true",
+			readyWhen:   `has(self.status.atProvider.endpoint) && self.status.atProvider.endpoint != ""`,
+			observed:    map[string]string{"db": available},
+			wantCreated: true,
+		},
+		"NotObservedIsNotReady": {
+			reason:    "readyWhen can only be satisfied by an observed resource",
+			readyWhen: `true`,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  "Delaying creation of resource(s) matching \"app\" because \"db\" is not fully ready (0 of 1)",
+					Target:   &target,
+				},
+			},
+		},
+		"EvaluationErrorIsFatal": {
+			reason:    "An expression that cannot be evaluated should produce a Fatal result",
+			readyWhen: `self.status.atProvider.endpoint != ""`,
+			observed:  map[string]string{"db": pending},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_FATAL,
+					Message:  "cannot check readiness for sequence [db app]: cannot evaluate readyWhen \"self.status.atProvider.endpoint != \\\"\\\"\" for resource \"db\": cannot evaluate CEL condition: no such key: endpoint",
+					Target:   &target,
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			observed := map[string]*v1.Resource{}
+			for n, o := range tc.observed {
+				observed[n] = &v1.Resource{Resource: resource.MustStructJSON(o)}
+			}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					Rules: []v1beta1.SequencingRule{
+						{
+							Steps: []v1beta1.SequenceStep{
+								{Resource: "db", ReadyWhen: tc.readyWhen},
+								{Resource: "app"},
+							},
+						},
+					},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: observed,
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: map[string]*v1.Resource{
+						"db":  {Resource: resource.MustStructJSON(mr), Ready: v1.Ready_READY_TRUE},
+						"app": {Resource: resource.MustStructJSON(mr)},
+					},
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			// Crossplane discards the desired state returned with a fatal
+			// result, so there is nothing to check.
+			if slices.ContainsFunc(rsp.GetResults(), func(r *v1.Result) bool { return r.GetSeverity() == v1.Severity_SEVERITY_FATAL }) {
+				return
+			}
+			if _, created := rsp.GetDesired().GetResources()["app"]; created != tc.wantCreated {
+				t.Errorf("%s\nf.RunFunction(...): want app created %t, got %t", tc.reason, tc.wantCreated, created)
+			}
+		})
+	}
+}
+
+func TestRunFunctionQuorum(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+	mr := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"}}`
+
+	delayed := func(msg string) []*v1.Result {
+		return []*v1.Result{
+			{
+				Severity: v1.Severity_SEVERITY_NORMAL,
+				Message:  "Delaying creation of resource(s) matching \"app\" because " + msg,
+				Target:   &target,
+			},
+		}
+	}
+
+	cases := map[string]struct {
+		reason      string
+		minReady    *intstr.IntOrString
+		minMatches  *int32
+		nodes       int
+		ready       int
+		wantResults []*v1.Result
+		wantCreated bool
+	}{
+		"DefaultRequiresAllReady": {
+			reason:      "Without minReady every matching resource must be ready",
+			nodes:       4,
+			ready:       3,
+			wantResults: delayed(`"node-.*" is not fully ready (3 of 4)`),
+		},
+		"AbsoluteCountReached": {
+			reason:      "Successors should be created once minReady resources are ready",
+			minReady:    ptr.To(intstr.FromInt32(3)),
+			nodes:       4,
+			ready:       3,
+			wantCreated: true,
+		},
+		"PercentageNotReached": {
+			reason:      "Percentages should be rounded up against the number of matching resources",
+			minReady:    ptr.To(intstr.FromString("80%")),
+			nodes:       4,
+			ready:       3,
+			wantResults: delayed(`"node-.*" is not sufficiently ready (3 of 4, 4 required)`),
+		},
+		"PercentageReached": {
+			reason:      "Successors should be created once the percentage of ready resources is reached",
+			minReady:    ptr.To(intstr.FromString("50%")),
+			nodes:       4,
+			ready:       2,
+			wantCreated: true,
+		},
+		"NotEnoughMatches": {
+			reason:      "Successors should wait until minMatches resources match the step",
+			minReady:    ptr.To(intstr.FromInt32(1)),
+			minMatches:  ptr.To[int32](5),
+			nodes:       4,
+			ready:       4,
+			wantResults: delayed(`only 4 resource(s) match "node-.*" (5 required)`),
+		},
+		"ZeroMatchesAllowed": {
+			reason:      "Successors should not wait for a step that may match no resources",
+			minMatches:  ptr.To[int32](0),
+			wantCreated: true,
+		},
+		"NegativeMinReady": {
+			reason:   "A negative minReady should return a fatal result",
+			minReady: ptr.To(intstr.FromInt32(-1)),
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_FATAL,
+					Message:  `invalid sequencing rule: invalid minReady "-1": must be a non-negative count or a percentage of at most 100%`,
+					Target:   &target,
+				},
+			},
+		},
+		"PercentageOver100": {
+			reason:   "A minReady percentage over 100% should return a fatal result",
+			minReady: ptr.To(intstr.FromString("150%")),
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_FATAL,
+					Message:  `invalid sequencing rule: invalid minReady "150%": must be a non-negative count or a percentage of at most 100%`,
+					Target:   &target,
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			desired := map[string]*v1.Resource{
+				"app": {Resource: resource.MustStructJSON(mr)},
+			}
+			for i := range tc.nodes {
+				d := &v1.Resource{Resource: resource.MustStructJSON(mr)}
+				if i < tc.ready {
+					d.Ready = v1.Ready_READY_TRUE
+				}
+				desired[fmt.Sprintf("node-%d", i)] = d
+			}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					Rules: []v1beta1.SequencingRule{
+						{
+							Steps: []v1beta1.SequenceStep{
+								{Resource: "node-.*", MinReady: tc.minReady, MinMatches: tc.minMatches},
+								{Resource: "app"},
+							},
+						},
+					},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: desired,
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			// Crossplane discards the desired state returned with a fatal
+			// result, so there is nothing to check.
+			if slices.ContainsFunc(rsp.GetResults(), func(r *v1.Result) bool { return r.GetSeverity() == v1.Severity_SEVERITY_FATAL }) {
+				return
+			}
+			if _, created := rsp.GetDesired().GetResources()["app"]; created != tc.wantCreated {
+				t.Errorf("%s\nf.RunFunction(...): want app created %t, got %t", tc.reason, tc.wantCreated, created)
+			}
+		})
+	}
+}
+
+func TestRunFunctionStages(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+	mr := func(name string) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":%q}}`, name)
+	}
+
+	cases := map[string]struct {
+		reason        string
+		ready         []string
+		observed      []string
+		deletion      bool
+		wantResults   []*v1.Result
+		wantResources []string
+	}{
+		"FirstStageNotReady": {
+			reason: "A stage should gate its successors until every resource in it is ready",
+			ready:  []string{"network"},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching stage 2 ("cluster", "bucket") because stage 1 ("network", "iam-role") is not ready: "iam-role" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app" because stage 1 ("network", "iam-role") is not ready: "iam-role" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"iam-role", "network"},
+		},
+		"FirstStageReady": {
+			reason: "Every resource of a stage should be created together once the previous stage is ready",
+			ready:  []string{"network", "iam-role", "cluster"},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app" because stage 2 ("cluster", "bucket") is not ready: "bucket" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"bucket", "cluster", "iam-role", "network"},
+		},
+		"AllStagesReady": {
+			reason:        "The step after the last stage should be created once every stage is ready",
+			ready:         []string{"network", "iam-role", "cluster", "bucket"},
+			wantResources: []string{"app", "bucket", "cluster", "iam-role", "network"},
+		},
+		"UsagesBetweenStages": {
+			reason:   "Every resource of a stage should be protected by every resource of the next stage",
+			ready:    []string{"network", "iam-role", "cluster", "bucket"},
+			observed: []string{"network", "iam-role", "cluster", "bucket"},
+			deletion: true,
+			wantResources: []string{
+				"app", "bucket", "bucket-iam-role-usage", "bucket-network-usage", "cluster",
+				"cluster-iam-role-usage", "cluster-network-usage", "iam-role", "network",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			desired := map[string]*v1.Resource{}
+			for _, n := range []string{"network", "iam-role", "cluster", "bucket", "app"} {
+				d := &v1.Resource{Resource: resource.MustStructJSON(mr(n))}
+				if slices.Contains(tc.ready, n) {
+					d.Ready = v1.Ready_READY_TRUE
+				}
+				desired[n] = d
+			}
+			observed := map[string]*v1.Resource{}
+			for _, n := range tc.observed {
+				observed[n] = &v1.Resource{Resource: resource.MustStructJSON(mr(n))}
+			}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					EnableDeletionSequencing: tc.deletion,
+					Rules: []v1beta1.SequencingRule{
+						{
+							Steps: []v1beta1.SequenceStep{
+								{Resources: []resource.Name{"network", "iam-role"}},
+								{Resources: []resource.Name{"cluster", "bucket"}},
+								{Resource: "app"},
+							},
+						},
+					},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: observed,
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: desired,
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			got := slices.Sorted(maps.Keys(rsp.GetDesired().GetResources()))
+			if diff := cmp.Diff(tc.wantResources, got); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want resources, +got resources:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionSoakDuration(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+	mr := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"}}`
+	readySince := func(d time.Duration) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"},"status":{"conditions":[{"type":"Ready","status":"True","reason":"Available","lastTransitionTime":%q}]}}`,
+			now.Add(-d).Format(time.RFC3339))
+	}
+	createdAgo := func(d time.Duration) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr","creationTimestamp":%q}}`,
+			now.Add(-d).Format(time.RFC3339))
+	}
+	soaking := []*v1.Result{
+		{
+			Severity: v1.Severity_SEVERITY_NORMAL,
+			Message:  `Delaying creation of resource(s) matching "role-binding" because "iam-role" has not been ready for 5m0s yet`,
+			Target:   &target,
+		},
+	}
+
+	cases := map[string]struct {
+		reason      string
+		soak        string
+		observed    string
+		wantResults []*v1.Result
+		wantCreated bool
+		wantTTL     time.Duration
+	}{
+		"NoSoakDuration": {
+			reason:      "Successors should be created as soon as the predecessor is ready",
+			observed:    readySince(0),
+			wantCreated: true,
+			wantTTL:     response.DefaultTTL,
+		},
+		"StillSoaking": {
+			reason:      "Successors should wait until the predecessor has been ready for the soak duration, and the TTL should end with the soak",
+			soak:        "5m",
+			observed:    readySince(4 * time.Minute),
+			wantResults: soaking,
+			wantTTL:     time.Minute,
+		},
+		"StillSoakingShortTTL": {
+			reason:      "The TTL should be shortened to the remaining soak time",
+			soak:        "5m",
+			observed:    readySince(4*time.Minute + 30*time.Second),
+			wantResults: soaking,
+			wantTTL:     30 * time.Second,
+		},
+		"Soaked": {
+			reason:      "Successors should be created once the soak duration has elapsed",
+			soak:        "5m",
+			observed:    readySince(5 * time.Minute),
+			wantCreated: true,
+			wantTTL:     response.DefaultTTL,
+		},
+		"NoReadyCondition": {
+			reason:      "A resource without an observed Ready condition should soak from its creation",
+			soak:        "5m",
+			observed:    createdAgo(4 * time.Minute),
+			wantResults: soaking,
+			wantTTL:     time.Minute,
+		},
+		"NoReadyConditionSoaked": {
+			reason:      "Successors should be created once a resource without an observed Ready condition has existed for the soak duration",
+			soak:        "5m",
+			observed:    createdAgo(5 * time.Minute),
+			wantCreated: true,
+			wantTTL:     response.DefaultTTL,
+		},
+		"NoCreationTimestamp": {
+			reason:      "A resource without an observed Ready condition or creationTimestamp should not have started soaking",
+			soak:        "5m",
+			observed:    mr,
+			wantResults: soaking,
+			wantTTL:     response.DefaultTTL,
+		},
+		"InvalidSoakDuration": {
+			reason:   "An invalid soak duration should return a fatal result",
+			soak:     "soon",
+			observed: mr,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_FATAL,
+					Message:  `invalid sequencing rule: cannot parse soakDuration "soon": time: invalid duration "soon"`,
+					Target:   &target,
+				},
+			},
+			wantCreated: true,
+			wantTTL:     response.DefaultTTL,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger(), clock: func() time.Time { return now }}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					Rules: []v1beta1.SequencingRule{
+						{
+							Steps: []v1beta1.SequenceStep{
+								{Resource: "iam-role", SoakDuration: tc.soak},
+								{Resource: "role-binding"},
+							},
+						},
+					},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: map[string]*v1.Resource{
+						"iam-role": {Resource: resource.MustStructJSON(tc.observed)},
+					},
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: map[string]*v1.Resource{
+						"iam-role":     {Resource: resource.MustStructJSON(mr), Ready: v1.Ready_READY_TRUE},
+						"role-binding": {Resource: resource.MustStructJSON(mr)},
+					},
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			if _, created := rsp.GetDesired().GetResources()["role-binding"]; created != tc.wantCreated {
+				t.Errorf("%s\nf.RunFunction(...): want role-binding created %t, got %t", tc.reason, tc.wantCreated, created)
+			}
+			if diff := cmp.Diff(tc.wantTTL, rsp.GetMeta().GetTtl().AsDuration()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want TTL, +got TTL:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionTimeout(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	xr := func(age time.Duration) string {
+		if age == 0 {
+			return `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+		}
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr","creationTimestamp":%q}}`,
+			now.Add(-age).Format(time.RFC3339))
+	}
+	mr := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"}}`
+	notReadySince := func(d time.Duration) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"},"status":{"conditions":[{"type":"Ready","status":"False","reason":"Creating","lastTransitionTime":%q}]}}`,
+			now.Add(-d).Format(time.RFC3339))
+	}
+	delayed := `Delaying creation of resource(s) matching "second" because "first" is not fully ready (0 of 1)`
+	waiting := &v1.Condition{
+		Type:    ConditionTypeSequencingComplete,
+		Status:  v1.Status_STATUS_CONDITION_FALSE,
+		Reason:  "WaitingOnPredecessors",
+		Message: ptr.To(`second waiting because "first" is not fully ready (0 of 1)`),
+		Target:  &target,
+	}
+
+	cases := map[string]struct {
+		reason         string
+		rule           v1beta1.SequencingRule
+		xrAge          time.Duration
+		observed       string
+		wantResults    []*v1.Result
+		wantConditions []*v1.Condition
+		wantCreated    bool
+		wantTTL        time.Duration
+	}{
+		"NotTimedOut": {
+			reason:         "A step that has not timed out should delay its successors as usual",
+			rule:           v1beta1.SequencingRule{Sequence: []resource.Name{"first", "second"}, Timeout: "10m"},
+			xrAge:          time.Hour,
+			observed:       notReadySince(9*time.Minute + 30*time.Second),
+			wantResults:    []*v1.Result{{Severity: v1.Severity_SEVERITY_NORMAL, Message: delayed, Target: &target}},
+			wantConditions: []*v1.Condition{waiting},
+			wantTTL:        30 * time.Second,
+		},
+		"WarnByDefault": {
+			reason:   "A step that timed out should be reported as a Warning by default",
+			rule:     v1beta1.SequencingRule{Sequence: []resource.Name{"first", "second"}, Timeout: "10m"},
+			xrAge:    time.Hour,
+			observed: notReadySince(11 * time.Minute),
+			wantResults: []*v1.Result{
+				{Severity: v1.Severity_SEVERITY_WARNING, Message: delayed + " for more than 10m0s", Target: &target},
+			},
+			wantConditions: []*v1.Condition{waiting},
+			wantTTL:        response.DefaultTTL,
+		},
+		"UnobservedUsesCompositeAge": {
+			reason: "The timeout of a step without observed resources should be measured from the creation of the composite",
+			rule: v1beta1.SequencingRule{
+				Steps: []v1beta1.SequenceStep{
+					{Resource: "first", Timeout: "10m", OnTimeout: v1beta1.TimeoutPolicyFatal},
+					{Resource: "second"},
+				},
+			},
+			xrAge: 11 * time.Minute,
+			wantResults: []*v1.Result{
+				{Severity: v1.Severity_SEVERITY_FATAL, Message: delayed + " for more than 10m0s", Target: &target},
+			},
+			wantCreated: true,
+			wantTTL:     response.DefaultTTL,
+		},
+		"NoCreationTimestamp": {
+			reason: "A step should not time out when its start time is unknown because the composite has no creationTimestamp",
+			rule: v1beta1.SequencingRule{
+				Steps: []v1beta1.SequenceStep{
+					{Resource: "first", Timeout: "1h", OnTimeout: v1beta1.TimeoutPolicyFatal},
+					{Resource: "second"},
+				},
+			},
+			wantResults:    []*v1.Result{{Severity: v1.Severity_SEVERITY_NORMAL, Message: delayed, Target: &target}},
+			wantConditions: []*v1.Condition{waiting},
+			wantTTL:        response.DefaultTTL,
+		},
+		"NoCreationTimestampProceed": {
+			reason:         "A step whose start time is unknown should not release its successors with the Proceed policy",
+			rule:           v1beta1.SequencingRule{Sequence: []resource.Name{"first", "second"}, Timeout: "1h", OnTimeout: v1beta1.TimeoutPolicyProceed},
+			wantResults:    []*v1.Result{{Severity: v1.Severity_SEVERITY_NORMAL, Message: delayed, Target: &target}},
+			wantConditions: []*v1.Condition{waiting},
+			wantTTL:        response.DefaultTTL,
+		},
+		"Proceed": {
+			reason:   "A step that timed out should release its successors with the Proceed policy",
+			rule:     v1beta1.SequencingRule{Sequence: []resource.Name{"first", "second"}, Timeout: "10m", OnTimeout: v1beta1.TimeoutPolicyProceed},
+			xrAge:    time.Hour,
+			observed: notReadySince(11 * time.Minute),
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_WARNING,
+					Message:  `Proceeding with creation of resource(s) matching "second" after waiting more than 10m0s, although "first" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantConditions: []*v1.Condition{
+				{
+					Type:   ConditionTypeSequencingComplete,
+					Status: v1.Status_STATUS_CONDITION_TRUE,
+					Reason: "Complete",
+					Target: &target,
+				},
+			},
+			wantCreated: true,
+			wantTTL:     response.DefaultTTL,
+		},
+		"SetCondition": {
+			reason:   "A step that timed out should set the SequencingStalled condition with the SetCondition policy",
+			rule:     v1beta1.SequencingRule{Sequence: []resource.Name{"first", "second"}, Timeout: "10m", OnTimeout: v1beta1.TimeoutPolicySetCondition},
+			xrAge:    time.Hour,
+			observed: notReadySince(11 * time.Minute),
+			wantResults: []*v1.Result{
+				{Severity: v1.Severity_SEVERITY_NORMAL, Message: delayed + " for more than 10m0s", Target: &target},
+			},
+			wantConditions: []*v1.Condition{
+				{
+					Type:    ConditionTypeSequencingStalled,
+					Status:  v1.Status_STATUS_CONDITION_TRUE,
+					Reason:  "Timeout",
+					Message: ptr.To(delayed + " for more than 10m0s"),
+					Target:  &target,
+				},
+				waiting,
+			},
+			wantTTL: response.DefaultTTL,
+		},
+		"SetConditionNotStalled": {
+			reason:      "The SequencingStalled condition should be cleared when nothing has timed out",
+			rule:        v1beta1.SequencingRule{Sequence: []resource.Name{"first", "second"}, Timeout: "1h", OnTimeout: v1beta1.TimeoutPolicySetCondition},
+			xrAge:       time.Hour,
+			observed:    notReadySince(time.Minute),
+			wantResults: []*v1.Result{{Severity: v1.Severity_SEVERITY_NORMAL, Message: delayed, Target: &target}},
+			wantConditions: []*v1.Condition{
+				{
+					Type:   ConditionTypeSequencingStalled,
+					Status: v1.Status_STATUS_CONDITION_FALSE,
+					Reason: "NotStalled",
+					Target: &target,
+				},
+				waiting,
+			},
+			wantTTL: response.DefaultTTL,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger(), clock: func() time.Time { return now }}
+			observed := map[string]*v1.Resource{}
+			if tc.observed != "" {
+				observed["first"] = &v1.Resource{Resource: resource.MustStructJSON(tc.observed)}
+			}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					Rules: []v1beta1.SequencingRule{tc.rule},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr(tc.xrAge))},
+					Resources: observed,
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr(tc.xrAge))},
+					Resources: map[string]*v1.Resource{
+						"first":  {Resource: resource.MustStructJSON(mr)},
+						"second": {Resource: resource.MustStructJSON(mr)},
+					},
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.wantConditions, rsp.GetConditions(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want conditions, +got conditions:\n%s", tc.reason, diff)
+			}
+			if _, created := rsp.GetDesired().GetResources()["second"]; created != tc.wantCreated {
+				t.Errorf("%s\nf.RunFunction(...): want second created %t, got %t", tc.reason, tc.wantCreated, created)
+			}
+			if diff := cmp.Diff(tc.wantTTL, rsp.GetMeta().GetTtl().AsDuration()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want TTL, +got TTL:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionTimeoutChain(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	xr := fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr","creationTimestamp":%q}}`,
+		now.Add(-40*time.Minute).Format(time.RFC3339))
+	mr := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"}}`
+	readySince := fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"},"status":{"conditions":[{"type":"Ready","status":"True","reason":"Available","lastTransitionTime":%q}]}}`,
+		now.Add(-5*time.Minute).Format(time.RFC3339))
+
+	// The composite is older than the timeout, but "b" was only unblocked
+	// when "a" became ready five minutes ago, so "c" must not time out on it.
+	f := &Function{log: logging.NewNopLogger(), clock: func() time.Time { return now }}
+	req := &v1.RunFunctionRequest{
+		Input: resource.MustStructObject(&v1beta1.Input{
+			Rules: []v1beta1.SequencingRule{{Sequence: []resource.Name{"a", "b", "c"}, Timeout: "30m"}},
+		}),
+		Observed: &v1.State{
+			Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+			Resources: map[string]*v1.Resource{
+				"a": {Resource: resource.MustStructJSON(readySince)},
+			},
+		},
+		Desired: &v1.State{
+			Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+			Resources: map[string]*v1.Resource{
+				"a": {Resource: resource.MustStructJSON(mr), Ready: v1.Ready_READY_TRUE},
+				"b": {Resource: resource.MustStructJSON(mr)},
+				"c": {Resource: resource.MustStructJSON(mr)},
+			},
+		},
+	}
+	rsp, err := f.RunFunction(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantResults := []*v1.Result{
+		{
+			Severity: v1.Severity_SEVERITY_NORMAL,
+			Message:  `Delaying creation of resource(s) matching "c" because "b" is not fully ready (0 of 1)`,
+			Target:   &target,
+		},
+	}
+	if diff := cmp.Diff(wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+		t.Errorf("f.RunFunction(...): -want results, +got results:\n%s", diff)
+	}
+	if diff := cmp.Diff(response.DefaultTTL, rsp.GetMeta().GetTtl().AsDuration()); diff != "" {
+		t.Errorf("f.RunFunction(...): -want TTL, +got TTL:\n%s", diff)
+	}
+}
+
+func TestRunFunctionSelectors(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+	subnet := `{"apiVersion":"ec2.aws.upbound.io/v1beta1","kind":"Subnet","metadata":{"name":"subnet","labels":{"tier":"network"}}}`
+	otherSubnet := `{"apiVersion":"ec2.aws.upbound.io/v1beta2","kind":"Subnet","metadata":{"name":"other-subnet","annotations":{"example.org/critical":"true"}}}`
+	cluster := `{"apiVersion":"eks.aws.upbound.io/v1beta1","kind":"Cluster","metadata":{"name":"cluster"}}`
+	subnets := &v1beta1.ResourceSelector{APIVersion: "ec2.aws.upbound.io", Kind: "Subnet"}
+	clusters := &v1beta1.ResourceSelector{APIVersion: "eks.aws.upbound.io/v1beta1", Kind: "Cluster"}
+
+	cases := map[string]struct {
+		reason        string
+		before        *v1beta1.ResourceSelector
+		ready         []string
+		observed      []string
+		deletion      bool
+		wantResults   []*v1.Result
+		wantResources []string
+	}{
+		"GroupAndKindNotReady": {
+			reason: "Every resource of the selected group and kind should be ready before successors are created",
+			before: subnets,
+			ready:  []string{"subnet-a"},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "apiVersion=eks.aws.upbound.io/v1beta1,kind=Cluster" because "apiVersion=ec2.aws.upbound.io,kind=Subnet" is not fully ready (1 of 2)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"subnet-a", "subnet-b"},
+		},
+		"GroupAndKindReady": {
+			reason:        "Successors should be created once every selected resource is ready",
+			before:        subnets,
+			ready:         []string{"subnet-a", "subnet-b"},
+			wantResources: []string{"cluster", "subnet-a", "subnet-b"},
+		},
+		"Labels": {
+			reason:        "Resources should be selectable by labels",
+			before:        &v1beta1.ResourceSelector{MatchLabels: map[string]string{"tier": "network"}},
+			ready:         []string{"subnet-a"},
+			wantResources: []string{"cluster", "subnet-a", "subnet-b"},
+		},
+		"Annotations": {
+			reason: "Resources should be selectable by annotations",
+			before: &v1beta1.ResourceSelector{MatchAnnotations: map[string]string{"example.org/critical": "true"}},
+			ready:  []string{"subnet-a"},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "apiVersion=eks.aws.upbound.io/v1beta1,kind=Cluster" because "annotation example.org/critical=true" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"subnet-a", "subnet-b"},
+		},
+		"Usages": {
+			reason:   "Usages should be generated between the selected resources",
+			before:   subnets,
+			ready:    []string{"subnet-a", "subnet-b"},
+			observed: []string{"subnet-a", "subnet-b", "cluster"},
+			deletion: true,
+			wantResources: []string{
+				"cluster", "cluster-subnet-a-usage", "cluster-subnet-b-usage", "subnet-a", "subnet-b",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			objects := map[string]string{"subnet-a": subnet, "subnet-b": otherSubnet, "cluster": cluster}
+			desired := map[string]*v1.Resource{}
+			for n, o := range objects {
+				d := &v1.Resource{Resource: resource.MustStructJSON(o)}
+				if slices.Contains(tc.ready, n) {
+					d.Ready = v1.Ready_READY_TRUE
+				}
+				desired[n] = d
+			}
+			observed := map[string]*v1.Resource{}
+			for _, n := range tc.observed {
+				observed[n] = &v1.Resource{Resource: resource.MustStructJSON(objects[n])}
+			}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					EnableDeletionSequencing: tc.deletion,
+					Rules: []v1beta1.SequencingRule{
+						{
+							Steps: []v1beta1.SequenceStep{
+								{Selector: tc.before},
+								{Selector: clusters},
+							},
+						},
+					},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: observed,
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: desired,
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			got := slices.Sorted(maps.Keys(rsp.GetDesired().GetResources()))
+			if diff := cmp.Diff(tc.wantResources, got); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want resources, +got resources:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionPairCaptureGroups(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+	mr := func(name string) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":%q}}`, name)
+	}
+
+	cases := map[string]struct {
+		reason        string
+		rule          v1beta1.SequencingRule
+		desired       []string
+		ready         []string
+		observed      []string
+		deletion      bool
+		wantResults   []*v1.Result
+		wantResources []string
+	}{
+		"Unpaired": {
+			reason: "Without pairing every app should wait for every database",
+			rule:   v1beta1.SequencingRule{Sequence: []resource.Name{"db-(.*)", "app-.*"}},
+			ready:  []string{"db-foo"},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app-.*" because "db-(.*)" is not fully ready (1 of 2)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"db-bar", "db-foo", "dns-bar", "dns-foo"},
+		},
+		"Paired": {
+			reason: "An app should only wait for the database it is paired with",
+			rule:   v1beta1.SequencingRule{Sequence: []resource.Name{"db-(.*)", "app-$1"}, PairCaptureGroups: true},
+			ready:  []string{"db-foo"},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app-bar" because "db-bar" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"app-foo", "db-bar", "db-foo", "dns-bar", "dns-foo"},
+		},
+		"PairedMissing": {
+			reason:  "An app without a database to pair with should wait for the database it would be paired with",
+			rule:    v1beta1.SequencingRule{Sequence: []resource.Name{"db-(.*)", "app-$1"}, PairCaptureGroups: true},
+			desired: []string{"app-foo"},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app-foo" because "db-foo" does not exist yet`,
+					Target:   &target,
+				},
+			},
+		},
+		"PairedTransitively": {
+			reason: "Pairing should carry over to later steps of the sequence",
+			rule:   v1beta1.SequencingRule{Sequence: []resource.Name{"db-(.*)", "app-${1}", "dns-$1"}, PairCaptureGroups: true},
+			ready:  []string{"db-foo", "db-bar", "app-foo"},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "dns-bar" because "app-bar" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"app-bar", "app-foo", "db-bar", "db-foo", "dns-foo"},
+		},
+		"PairedUsages": {
+			reason:   "Usages should only be generated between paired resources",
+			rule:     v1beta1.SequencingRule{Sequence: []resource.Name{"db-(.*)", "app-$1"}, PairCaptureGroups: true},
+			ready:    []string{"db-foo", "db-bar"},
+			observed: []string{"db-foo", "db-bar", "app-foo", "app-bar"},
+			deletion: true,
+			wantResources: []string{
+				"app-bar", "app-bar-db-bar-usage", "app-foo", "app-foo-db-foo-usage", "db-bar", "db-foo", "dns-bar", "dns-foo",
+			},
+		},
+		"PairedStage": {
+			reason: "Pairing should be rejected for stages",
+			rule: v1beta1.SequencingRule{
+				Steps: []v1beta1.SequenceStep{
+					{Resources: []resource.Name{"db-(.*)", "cache-(.*)"}},
+					{Resource: "app-$1"},
+				},
+				PairCaptureGroups: true,
+			},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_FATAL,
+					Message:  "invalid sequencing rule: pairCaptureGroups requires every step to be a single resource name or regex",
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"app-bar", "app-foo", "db-bar", "db-foo", "dns-bar", "dns-foo"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			names := tc.desired
+			if names == nil {
+				names = []string{"db-foo", "db-bar", "app-foo", "app-bar", "dns-foo", "dns-bar"}
+			}
+			desired := map[string]*v1.Resource{}
+			for _, n := range names {
+				d := &v1.Resource{Resource: resource.MustStructJSON(mr(n))}
+				if slices.Contains(tc.ready, n) {
+					d.Ready = v1.Ready_READY_TRUE
+				}
+				desired[n] = d
+			}
+			observed := map[string]*v1.Resource{}
+			for _, n := range tc.observed {
+				observed[n] = &v1.Resource{Resource: resource.MustStructJSON(mr(n))}
+			}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					EnableDeletionSequencing: tc.deletion,
+					Rules:                    []v1beta1.SequencingRule{tc.rule},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: observed,
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: desired,
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			got := slices.Sorted(maps.Keys(rsp.GetDesired().GetResources()))
+			if diff := cmp.Diff(tc.wantResources, got); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want resources, +got resources:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionDependsOnAnnotation(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+	mr := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"}}`
+	app := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"app","annotations":{"sequencer.fn.crossplane.io/depends-on":"vpc, subnet-.*","example.org/keep":"true"}}}`
+
+	cases := map[string]struct {
+		reason      string
+		rules       []v1beta1.SequencingRule
+		ready       []string
+		wantResults []*v1.Result
+		wantCreated []string
+	}{
+		"NotReady": {
+			reason: "A resource should wait for the resources listed in its depends-on annotation",
+			ready:  []string{"vpc", "subnet-a"},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app" because "subnet-.*" is not fully ready (1 of 2)`,
+					Target:   &target,
+				},
+			},
+			wantCreated: []string{"subnet-a", "subnet-b", "vpc"},
+		},
+		"Ready": {
+			reason:      "A resource should be created once the resources listed in its depends-on annotation are ready",
+			ready:       []string{"vpc", "subnet-a", "subnet-b"},
+			wantCreated: []string{"app", "subnet-a", "subnet-b", "vpc"},
+		},
+		"MergedWithInputRules": {
+			reason: "Annotated dependencies should be merged with the rules of the input",
+			rules:  []v1beta1.SequencingRule{{Sequence: []resource.Name{"vpc", "subnet-.*"}}},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "subnet-.*" because "vpc" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app" because "vpc" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantCreated: []string{"vpc"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			desired := map[string]*v1.Resource{"app": {Resource: resource.MustStructJSON(app)}}
+			for _, n := range []string{"vpc", "subnet-a", "subnet-b"} {
+				d := &v1.Resource{Resource: resource.MustStructJSON(mr)}
+				if slices.Contains(tc.ready, n) {
+					d.Ready = v1.Ready_READY_TRUE
+				}
+				desired[n] = d
+			}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{Rules: tc.rules}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: desired,
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			got := slices.Sorted(maps.Keys(rsp.GetDesired().GetResources()))
+			if diff := cmp.Diff(tc.wantCreated, got); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want resources, +got resources:\n%s", tc.reason, diff)
+			}
+			if a, ok := rsp.GetDesired().GetResources()["app"]; ok {
+				want := map[string]any{"example.org/keep": "true"}
+				got := a.GetResource().AsMap()["metadata"].(map[string]any)["annotations"]
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Errorf("%s\nf.RunFunction(...): -want annotations, +got annotations:\n%s", tc.reason, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestRunFunctionSyncWaves(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+	mr := func(name, wave string) string {
+		if wave == "" {
+			return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":%q}}`, name)
+		}
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":%q,"annotations":{"sequencer.fn.crossplane.io/wave":%q}}}`, name, wave)
+	}
+	usage := func(name string) string {
+		return fmt.Sprintf(`{"apiVersion":"protection.crossplane.io/v1beta1","kind":"ClusterUsage","metadata":{"name":%q},"spec":{"replayDeletion":true}}`, name)
+	}
+
+	cases := map[string]struct {
+		reason        string
+		waves         []v1beta1.SyncWave
+		annotations   map[string]string
+		ready         []string
+		observed      []string
+		usages        []string
+		deletion      bool
+		wantResults   []*v1.Result
+		wantResources []string
+	}{
+		"NoWaves": {
+			reason:        "Resources should not be sequenced when no resource is assigned a wave",
+			wantResources: []string{"app", "cluster", "network"},
+		},
+		"Annotations": {
+			reason:      "Resources should wait for every resource in the waves before theirs",
+			annotations: map[string]string{"network": "-1", "app": "1"},
+			ready:       []string{"network"},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching wave 1 ("app") because wave 0 ("cluster") is not ready: "cluster" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"cluster", "network"},
+		},
+		"Mapping": {
+			reason: "Resources should be assigned to waves by the mapping of the input",
+			waves: []v1beta1.SyncWave{
+				{Wave: 1, Resources: []resource.Name{"cluster"}},
+				{Wave: 2, Resources: []resource.Name{"app"}},
+			},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching wave 1 ("cluster") because wave 0 ("network") is not ready: "network" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching wave 2 ("app") because wave 0 ("network") is not ready: "network" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"network"},
+		},
+		"AnnotationOverridesMapping": {
+			reason:      "The wave annotation should take precedence over the mapping of the input",
+			waves:       []v1beta1.SyncWave{{Wave: 1, Resources: []resource.Name{".*"}}},
+			annotations: map[string]string{"network": "0"},
+			ready:       []string{"network"},
+			wantResources: []string{
+				"app", "cluster", "network",
+			},
+		},
+		"Usages": {
+			reason:      "Usages should be generated between consecutive waves",
+			annotations: map[string]string{"network": "0", "cluster": "1", "app": "2"},
+			ready:       []string{"network", "cluster"},
+			observed:    []string{"network", "cluster", "app"},
+			deletion:    true,
+			wantResources: []string{
+				"app", "app-cluster-usage", "cluster", "cluster-network-usage", "network",
+			},
+		},
+		"UsageObjectsNotWaited": {
+			reason:        "Resources should not wait for Usage objects in the waves before theirs",
+			annotations:   map[string]string{"network": "0", "cluster": "1", "app": "2"},
+			ready:         []string{"network", "cluster"},
+			usages:        []string{"protect-network"},
+			wantResources: []string{"app", "cluster", "network", "protect-network"},
+		},
+		"UsageObjectsNotProtected": {
+			reason:      "Usages should not be generated for Usage objects",
+			annotations: map[string]string{"network": "0", "cluster": "1", "app": "2"},
+			ready:       []string{"network", "cluster"},
+			observed:    []string{"network", "cluster", "app", "protect-network"},
+			usages:      []string{"protect-network"},
+			deletion:    true,
+			wantResources: []string{
+				"app", "app-cluster-usage", "cluster", "cluster-network-usage", "network", "protect-network",
+			},
+		},
+		"InvalidAnnotation": {
+			reason:      "A wave annotation that is not an integer should return a fatal result",
+			annotations: map[string]string{"app": "last"},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_FATAL,
+					Message:  `cannot assign sync waves: invalid sequencer.fn.crossplane.io/wave annotation on resource "app": strconv.Atoi: parsing "last": invalid syntax`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"app", "cluster", "network"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			desired := map[string]*v1.Resource{}
+			for _, n := range []string{"network", "cluster", "app"} {
+				d := &v1.Resource{Resource: resource.MustStructJSON(mr(n, tc.annotations[n]))}
+				if slices.Contains(tc.ready, n) {
+					d.Ready = v1.Ready_READY_TRUE
+				}
+				desired[n] = d
+			}
+			for _, n := range tc.usages {
+				desired[n] = &v1.Resource{Resource: resource.MustStructJSON(usage(n))}
+			}
+			observed := map[string]*v1.Resource{}
+			for _, n := range tc.observed {
+				if slices.Contains(tc.usages, n) {
+					observed[n] = &v1.Resource{Resource: resource.MustStructJSON(usage(n))}
+					continue
+				}
+				observed[n] = &v1.Resource{Resource: resource.MustStructJSON(mr(n, ""))}
+			}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					EnableDeletionSequencing: tc.deletion,
+					Waves:                    tc.waves,
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: observed,
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: desired,
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			got := slices.Sorted(maps.Keys(rsp.GetDesired().GetResources()))
+			if diff := cmp.Diff(tc.wantResources, got); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want resources, +got resources:\n%s", tc.reason, diff)
+			}
+			if tc.wantResults == nil || tc.wantResults[0].GetSeverity() != v1.Severity_SEVERITY_FATAL {
+				for n, r := range rsp.GetDesired().GetResources() {
+					if _, ok := r.GetResource().AsMap()["metadata"].(map[string]any)["annotations"]; ok && !strings.HasSuffix(n, "-usage") {
+						t.Errorf("%s\nf.RunFunction(...): want wave annotation removed from %q", tc.reason, n)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRunFunctionWhen(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := func(cache bool) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"cache":{"enabled":%t}}}`, cache)
+	}
+	mr := func(name string) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":%q}}`, name)
+	}
+
+	cases := map[string]struct {
+		reason        string
+		when          string
+		cache         bool
+		ready         []string
+		observed      []string
+		deletion      bool
+		wantResults   []*v1.Result
+		wantResources []string
+	}{
+		"StepEnabled": {
+			reason: "A step whose condition is true should be waited on",
+			when:   "observed.composite.resource.spec.cache.enabled",
+			cache:  true,
+			ready:  []string{"network"},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app" because "cache" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"cache", "network"},
+		},
+		"StepBypassed": {
+			reason:        "A step whose condition is false should not be waited on",
+			when:          "observed.composite.resource.spec.cache.enabled",
+			ready:         []string{"network"},
+			wantResources: []string{"app", "cache", "network"},
+		},
+		"SuccessorsWaitAcrossGap": {
+			reason: "The successors of a bypassed step should wait on the step before it",
+			when:   "observed.composite.resource.spec.cache.enabled",
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app" because "network" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"cache", "network"},
+		},
+		"UsagesAcrossGap": {
+			reason:        "Usages should link the successors of a bypassed step to the step before it",
+			when:          "observed.composite.resource.spec.cache.enabled",
+			ready:         []string{"network"},
+			observed:      []string{"network", "cache", "app"},
+			deletion:      true,
+			wantResources: []string{"app", "app-network-usage", "cache", "network"},
+		},
+		"InvalidCondition": {
+			reason: "A step condition that cannot be evaluated should return a fatal result",
+			when:   "observed.composite.resource.spec.cache",
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_FATAL,
+					Message:  `cannot evaluate when "observed.composite.resource.spec.cache" for step "cache" of sequence [network cache app]: CEL condition result is not bool`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"app", "cache", "network"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			desired := map[string]*v1.Resource{}
+			for _, n := range []string{"network", "cache", "app"} {
+				d := &v1.Resource{Resource: resource.MustStructJSON(mr(n))}
+				if slices.Contains(tc.ready, n) {
+					d.Ready = v1.Ready_READY_TRUE
+				}
+				desired[n] = d
+			}
+			observed := map[string]*v1.Resource{}
+			for _, n := range tc.observed {
+				observed[n] = &v1.Resource{Resource: resource.MustStructJSON(mr(n))}
+			}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					EnableDeletionSequencing: tc.deletion,
+					Rules: []v1beta1.SequencingRule{
+						{
+							Steps: []v1beta1.SequenceStep{
+								{Resource: "network"},
+								{Resource: "cache", When: tc.when},
+								{Resource: "app"},
+							},
+						},
+					},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr(tc.cache))},
+					Resources: observed,
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr(tc.cache))},
+					Resources: desired,
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			got := slices.Sorted(maps.Keys(rsp.GetDesired().GetResources()))
+			if diff := cmp.Diff(tc.wantResources, got); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want resources, +got resources:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestEvaluateConditionHelpers(t *testing.T) {
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"name":"Cool"}}`
+	mr := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"}}`
+	readyMR := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"},"status":{"conditions":[{"type":"Ready","status":"True","reason":"Available"},{"type":"Synced","status":"False","reason":"ReconcileError"}]}}`
+	req := &v1.RunFunctionRequest{
+		Observed: &v1.State{
+			Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+			Resources: map[string]*v1.Resource{
+				"db": {Resource: resource.MustStructJSON(readyMR)},
+			},
+		},
+		Desired: &v1.State{
+			Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+			Resources: map[string]*v1.Resource{
+				"db":     {Resource: resource.MustStructJSON(mr)},
+				"node-0": {Resource: resource.MustStructJSON(mr), Ready: v1.Ready_READY_TRUE},
+				"node-1": {Resource: resource.MustStructJSON(mr)},
+			},
+		},
+	}
+
+	cases := map[string]struct {
+		reason    string
+		source    v1beta1.ReadinessSource
+		condition string
+		want      bool
+		wantErr   bool
+	}{
+		"IsReadyDesired": {
+			reason:    "isReady should use the desired readiness by default",
+			condition: `isReady("node-0") && !isReady("db")`,
+			want:      true,
+		},
+		"IsReadyObserved": {
+			reason:    "isReady should honor the readiness source",
+			source:    v1beta1.ReadinessSourceObserved,
+			condition: `!isReady("db") && !isReady("node-0")`,
+			want:      true,
+		},
+		"Exists": {
+			reason:    "exists should report whether a resource was observed",
+			condition: `exists("db") && !exists("node-0")`,
+			want:      true,
+		},
+		"Matching": {
+			reason:    "matching should return the sorted names of the matching desired resources",
+			condition: `matching("node-.*") == ["node-0", "node-1"]`,
+			want:      true,
+		},
+		"ReadyCount": {
+			reason:    "readyCount should count the ready resources matching a regex",
+			condition: `readyCount("node-.*") == 1`,
+			want:      true,
+		},
+		"Condition": {
+			reason:    "condition should return the status of a condition, or Unknown",
+			condition: `condition("db", "Synced") == "False" && condition("node-0", "Ready") == "Unknown"`,
+			want:      true,
+		},
+		"Extensions": {
+			reason:    "The standard extensions should be available",
+			condition: `observed.composite.resource.spec.name.lowerAscii() == "cool" && math.greatest(1, 2) == 2 && base64.encode(b"a") == "YQ==" && [2, 1].sort() == [1, 2] && optional.of(1).hasValue()`,
+			want:      true,
+		},
+		"InvalidRegex": {
+			reason:    "An invalid regex should return an error",
+			condition: `readyCount("node-(") == 0`,
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			got, err := f.evaluateCondition(req, tc.source, tc.condition, nil)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("%s\nf.evaluateCondition(...): want error %t, got %v", tc.reason, tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Errorf("%s\nf.evaluateCondition(...): want %t, got %t", tc.reason, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache[string, int](2)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("Get(a): want cached value")
+	}
+	// b is now the least recently used entry.
+	c.Add("c", 3)
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("Get(b): want least recently used entry evicted")
+	}
+	for k, want := range map[string]int{"a": 1, "c": 3} {
+		if got, ok := c.Get(k); !ok || got != want {
+			t.Errorf("Get(%s): want %d, got %d (cached %t)", k, want, got, ok)
+		}
+	}
+	if c.Len() != 2 {
+		t.Errorf("Len(): want 2, got %d", c.Len())
+	}
+}
+
+func TestCompileConditionCache(t *testing.T) {
+	// Start from an empty cache, so the first compilation is always a miss
+	// however often the test runs.
+	cached := celPrograms
+	celPrograms = newLRUCache[celProgramKey, cel.Program](celProgramCacheSize)
+	t.Cleanup(func() { celPrograms = cached })
+
+	condition := `observed.composite.resource.metadata.name == "TestCompileConditionCache"`
+	hits, misses := testutil.ToFloat64(celProgramCacheHits), testutil.ToFloat64(celProgramCacheMisses)
+
+	first, err := compileCondition(condition, 0)
+	if err != nil {
+		t.Fatalf("compileCondition(...): unexpected error: %v", err)
+	}
+	second, err := compileCondition(condition, 0)
+	if err != nil {
+		t.Fatalf("compileCondition(...): unexpected error: %v", err)
+	}
+	if first != second {
+		t.Errorf("compileCondition(...): want the cached program to be reused")
+	}
+	if got := testutil.ToFloat64(celProgramCacheMisses) - misses; got != 1 {
+		t.Errorf("compileCondition(...): want 1 cache miss, got %v", got)
+	}
+	if got := testutil.ToFloat64(celProgramCacheHits) - hits; got != 1 {
+		t.Errorf("compileCondition(...): want 1 cache hit, got %v", got)
+	}
+}
+
+func TestRunFunctionCELLimits(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+	mr := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"}}`
+	expensive := `lists.range(1000).all(x, x >= 0)`
+
+	cases := map[string]struct {
+		reason      string
+		costLimit   uint64
+		timeout     time.Duration
+		wantResults []*v1.Result
+	}{
+		"WithinLimits": {
+			reason:    "An expression within its budget should be evaluated",
+			costLimit: 10000000,
+			timeout:   time.Minute,
+		},
+		"CostLimitExceeded": {
+			reason:    "An expression exceeding the cost limit should return a fatal result naming the rule",
+			costLimit: 1000,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_FATAL,
+					Message:  `cannot evaluate condition "` + expensive + `" for sequence expensive-rule: CEL condition exceeded the cost limit of 1000`,
+					Target:   &target,
+				},
+			},
+		},
+		"TimeoutExceeded": {
+			reason:  "An expression exceeding the evaluation timeout should return a fatal result naming the rule",
+			timeout: time.Nanosecond,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_FATAL,
+					Message:  `cannot evaluate condition "` + expensive + `" for sequence expensive-rule: CEL condition exceeded the evaluation timeout of 1ns`,
+					Target:   &target,
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger(), celCostLimit: tc.costLimit, celTimeout: tc.timeout}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					Rules: []v1beta1.SequencingRule{
+						{Name: "expensive-rule", Sequence: []resource.Name{"first", "second"}, Condition: expensive},
+					},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: map[string]*v1.Resource{
+						"first":  {Resource: resource.MustStructJSON(mr), Ready: v1.Ready_READY_TRUE},
+						"second": {Resource: resource.MustStructJSON(mr)},
+					},
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionOnError(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	// The composite has no status yet, so expressions reading it cannot be evaluated.
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+	mr := func(name string) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":%q}}`, name)
+	}
+	const missing = "observed.composite.resource.status.ready"
+
+	cases := map[string]struct {
+		reason        string
+		onError       v1beta1.ErrorPolicy
+		condition     string
+		when          string
+		readyWhen     string
+		wantResults   []*v1.Result
+		wantResources []string
+	}{
+		"ConditionFatalByDefault": {
+			reason:    "A rule condition that cannot be evaluated should return a fatal result by default",
+			condition: missing,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_FATAL,
+					Message:  `cannot evaluate condition "observed.composite.resource.status.ready" for sequence [network cache app]: cannot evaluate CEL condition: no such key: status`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"app", "cache", "network"},
+		},
+		"ConditionTreatAsFalse": {
+			reason:    "A rule condition treated as false should skip the sequence",
+			onError:   v1beta1.ErrorPolicyTreatAsFalse,
+			condition: missing,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Skipping sequence [network cache app]: condition "observed.composite.resource.status.ready" evaluated to false`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"app", "cache", "network"},
+		},
+		"ConditionTreatAsTrue": {
+			reason:    "A rule condition treated as true should sequence the resources",
+			onError:   v1beta1.ErrorPolicyTreatAsTrue,
+			condition: missing,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app" because "cache" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"cache", "network"},
+		},
+		"ConditionWarn": {
+			reason:    "A rule condition that cannot be evaluated should be reported as a warning and skip the sequence",
+			onError:   v1beta1.ErrorPolicyWarn,
+			condition: missing,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_WARNING,
+					Message:  `cannot evaluate condition "observed.composite.resource.status.ready" for sequence [network cache app]: cannot evaluate CEL condition: no such key: status`,
+					Target:   &target,
+				},
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Skipping sequence [network cache app]: condition "observed.composite.resource.status.ready" evaluated to false`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"app", "cache", "network"},
+		},
+		"WhenTreatAsTrue": {
+			reason:  "A step condition treated as true should keep the step",
+			onError: v1beta1.ErrorPolicyTreatAsTrue,
+			when:    missing,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app" because "cache" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"cache", "network"},
+		},
+		"WhenWarn": {
+			reason:  "A step condition that cannot be evaluated should be reported as a warning and bypass the step",
+			onError: v1beta1.ErrorPolicyWarn,
+			when:    missing,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_WARNING,
+					Message:  `cannot evaluate when "observed.composite.resource.status.ready" for step "cache" of sequence [network cache app]: cannot evaluate CEL condition: no such key: status`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"app", "cache", "network"},
+		},
+		"ReadyWhenTreatAsFalse": {
+			reason:    "A readyWhen expression treated as false should keep the successors waiting",
+			onError:   v1beta1.ErrorPolicyTreatAsFalse,
+			readyWhen: missing,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "cache" because "network" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app" because "network" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"network"},
+		},
+		"ReadyWhenWarnOnce": {
+			reason:    "A readyWhen expression that cannot be evaluated should be reported once even if it is checked for several successors",
+			onError:   v1beta1.ErrorPolicyWarn,
+			readyWhen: missing,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_WARNING,
+					Message:  `cannot evaluate readyWhen "observed.composite.resource.status.ready" for resource "network": cannot evaluate CEL condition: no such key: status`,
+					Target:   &target,
+				},
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "cache" because "network" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app" because "network" is not fully ready (0 of 1)`,
+					Target:   &target,
 				},
 			},
+			wantResources: []string{"network"},
 		},
 	}
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
 			f := &Function{log: logging.NewNopLogger()}
+			desired := map[string]*v1.Resource{}
+			for _, n := range []string{"network", "cache", "app"} {
+				desired[n] = &v1.Resource{Resource: resource.MustStructJSON(mr(n))}
+			}
+			desired["network"].Ready = v1.Ready_READY_TRUE
 			req := &v1.RunFunctionRequest{
-				Input: resource.MustStructObject(tc.input),
+				Input: resource.MustStructObject(&v1beta1.Input{
+					Rules: []v1beta1.SequencingRule{
+						{
+							Condition: tc.condition,
+							OnError:   tc.onError,
+							Steps: []v1beta1.SequenceStep{
+								{Resource: "network", ReadyWhen: tc.readyWhen},
+								{Resource: "cache", When: tc.when},
+								{Resource: "app"},
+							},
+						},
+					},
+				}),
 				Observed: &v1.State{
-					Composite: &v1.Resource{
-						Resource: resource.MustStructJSON(xr),
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: map[string]*v1.Resource{
+						"network": {Resource: resource.MustStructJSON(mr("network"))},
 					},
-					Resources: map[string]*v1.Resource{},
 				},
 				Desired: &v1.State{
-					Composite: &v1.Resource{
-						Resource: resource.MustStructJSON(xr),
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: desired,
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			got := slices.Sorted(maps.Keys(rsp.GetDesired().GetResources()))
+			if diff := cmp.Diff(tc.wantResources, got); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want resources, +got resources:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionStatusField(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+	mr := func(name string) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":%q}}`, name)
+	}
+
+	cases := map[string]struct {
+		reason      string
+		field       string
+		condition   string
+		ready       []string
+		observed    []string
+		wantResults []*v1.Result
+		wantXR      string
+	}{
+		"NoStatusField": {
+			reason: "No report should be written unless a statusField is set",
+			ready:  []string{"network", "db"},
+			wantXR: xr,
+		},
+		"WaitingOnPredecessors": {
+			reason: "The report should name the first step that is not ready, count ready resources and list the blocked ones",
+			field:  "status.sequencer",
+			ready:  []string{"network"},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app" because "db" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantXR: `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"status":{"sequencer":{"rules":[
+				{"index":0,"name":"stack","stage":1,"steps":3,"blocked":["app"],"patterns":[
+					{"pattern":"network","ready":1,"total":1},
+					{"pattern":"db","ready":0,"total":1},
+					{"pattern":"app","ready":0,"total":1}
+				]}
+			]}}}`,
+		},
+		"SkippedWithUsages": {
+			reason:    "The report should mark skipped rules and list the Usages generated for them",
+			field:     "status.sequencer",
+			ready:     []string{"network", "db", "app"},
+			observed:  []string{"network", "db", "app"},
+			condition: "false",
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Skipping sequence stack: condition "false" evaluated to false`,
+					Target:   &target,
+				},
+			},
+			wantXR: `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"status":{"sequencer":{"rules":[
+				{"index":0,"name":"stack","skipped":true,"stage":3,"steps":3,
+					"usages":["mr-app-mr-db-55ce85-dependency","mr-db-mr-network-bfd5c8-dependency"],
+					"patterns":[
+						{"pattern":"network","ready":1,"total":1},
+						{"pattern":"db","ready":1,"total":1},
+						{"pattern":"app","ready":1,"total":1}
+					]}
+			]}}}`,
+		},
+		"NotAStatusField": {
+			reason: "A statusField outside of the composite status should return a fatal result",
+			field:  "spec.sequencer",
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_FATAL,
+					Message:  `statusField "spec.sequencer" must be a field of the composite status`,
+					Target:   &target,
+				},
+			},
+			wantXR: xr,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			desired := map[string]*v1.Resource{}
+			for _, n := range []string{"network", "db", "app"} {
+				d := &v1.Resource{Resource: resource.MustStructJSON(mr(n))}
+				if slices.Contains(tc.ready, n) {
+					d.Ready = v1.Ready_READY_TRUE
+				}
+				desired[n] = d
+			}
+			observed := map[string]*v1.Resource{}
+			for _, n := range tc.observed {
+				observed[n] = &v1.Resource{Resource: resource.MustStructJSON(mr(n))}
+			}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					EnableDeletionSequencing: true,
+					StatusField:              tc.field,
+					Rules: []v1beta1.SequencingRule{
+						{Name: "stack", Condition: tc.condition, Sequence: []resource.Name{"network", "db", "app"}},
 					},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: observed,
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: desired,
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(resource.MustStructJSON(tc.wantXR), rsp.GetDesired().GetComposite().GetResource(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want desired composite, +got desired composite:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionStateContextKey(t *testing.T) {
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+	mr := func(name string) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":%q}}`, name)
+	}
+
+	cases := map[string]struct {
+		reason  string
+		rule    v1beta1.SequencingRule
+		context string
+		want    string
+	}{
+		"Blocked": {
+			reason: "Resources withheld from the desired state should be published as blocked",
+			rule:   v1beta1.SequencingRule{Sequence: []resource.Name{"network", "cache", "app"}},
+			want: `{"sequencer.fn.crossplane.io/state":{
+				"rules":[{"index":0,"steps":[["network"],["cache"],["app"]],"released":["cache","network"],"blocked":["app"],"skipped":[]}],
+				"blocked":["app"]
+			}}`,
+		},
+		"BypassedStep": {
+			reason: "Resources only matching bypassed steps should be published as skipped",
+			rule: v1beta1.SequencingRule{
+				Name: "stack",
+				Steps: []v1beta1.SequenceStep{
+					{Resource: "network"},
+					{Resource: "cache", When: "false"},
+					{Resource: "app"},
+				},
+			},
+			want: `{"sequencer.fn.crossplane.io/state":{
+				"rules":[{"index":0,"name":"stack","steps":[["network"],["app"]],"released":["app","network"],"blocked":[],"skipped":["cache"]}],
+				"blocked":[]
+			}}`,
+		},
+		"SkippedRule": {
+			reason: "Every resource of a rule whose condition is false should be published as skipped",
+			rule:   v1beta1.SequencingRule{Condition: "false", Sequence: []resource.Name{"network", "cache", "app"}},
+			want: `{"sequencer.fn.crossplane.io/state":{
+				"rules":[{"index":0,"steps":[["network"],["cache"],["app"]],"released":[],"blocked":[],"skipped":["app","cache","network"]}],
+				"blocked":[]
+			}}`,
+		},
+		"ExistingContext": {
+			reason:  "Context keys set by earlier functions should be kept",
+			rule:    v1beta1.SequencingRule{Sequence: []resource.Name{"network", "cache", "app"}},
+			context: `{"example.org/key":"value"}`,
+			want: `{"example.org/key":"value","sequencer.fn.crossplane.io/state":{
+				"rules":[{"index":0,"steps":[["network"],["cache"],["app"]],"released":["cache","network"],"blocked":["app"],"skipped":[]}],
+				"blocked":["app"]
+			}}`,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					Rules: []v1beta1.SequencingRule{tc.rule},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
 					Resources: map[string]*v1.Resource{
-						"second": {
-							Resource: resource.MustStructJSON(xr),
-						},
+						"network": {Resource: resource.MustStructJSON(mr("network")), Ready: v1.Ready_READY_TRUE},
+						"cache":   {Resource: resource.MustStructJSON(mr("cache"))},
+						"app":     {Resource: resource.MustStructJSON(mr("app"))},
 					},
 				},
 			}
+			if tc.context != "" {
+				req.Context = resource.MustStructJSON(tc.context)
+			}
 			rsp, err := f.RunFunction(context.Background(), req)
-			if diff := cmp.Diff(tc.want, rsp, protocmp.Transform()); diff != "" {
-				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
 			}
-			if diff := cmp.Diff(nil, err, cmpopts.EquateErrors()); diff != "" {
-				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			if diff := cmp.Diff(resource.MustStructJSON(tc.want), rsp.GetContext(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want context, +got context:\n%s", tc.reason, diff)
 			}
 		})
 	}
 }
 
-func TestRunFunctionConditionErrors(t *testing.T) {
-	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
-	mr := `{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"cool-mr"}}`
+func TestRunFunctionEnforce(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+	mr := func(name string) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":%q}}`, name)
+	}
+	annotated := fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":"network","annotations":{%q:"app",%q:"1"}}}`,
+		DependsOnAnnotation, WaveAnnotation)
+	state := `{"sequencer.fn.crossplane.io/state":{
+		"rules":[{"index":0,"name":"stack","steps":[["network"],["app"]],"released":["network"],"blocked":["app"],"skipped":[]}],
+		"blocked":["app"]
+	}}`
 
 	cases := map[string]struct {
-		reason    string
-		condition string
+		reason        string
+		context       string
+		annotate      bool
+		observed      []string
+		wantResults   []*v1.Result
+		wantResources []string
 	}{
-		"InvalidExpression": {
-			reason:    "Invalid CEL syntax should produce Fatal",
-			condition: `invalid $$$ expression`,
+		"AddedBack": {
+			reason:  "A blocked resource added back by a later step should be removed again",
+			context: state,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_WARNING,
+					Message:  "Removing resource(s) app blocked by sequence stack that a later pipeline step added back to the desired state",
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"network"},
 		},
-		"NonBoolResult": {
-			reason:    "CEL expression returning non-bool should produce Fatal",
-			condition: `observed.composite.resource.spec.count`,
+		"StripsAnnotations": {
+			reason:        "Annotations meant for the function that a later step set should be removed",
+			context:       state,
+			annotate:      true,
+			observed:      []string{"app"},
+			wantResources: []string{"app", "network"},
+		},
+		"AlreadyObserved": {
+			reason:        "A blocked resource that already exists should not be removed, since that would delete it",
+			context:       state,
+			observed:      []string{"app"},
+			wantResources: []string{"app", "network"},
+		},
+		"SequencedAgain": {
+			reason: "Without a published state the resources should be sequenced again and every withheld resource reported",
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app" because "network" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+				{
+					Severity: v1.Severity_SEVERITY_WARNING,
+					Message:  `Removing resource(s) app that a later pipeline step added back to the desired state, because "network" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"network"},
+		},
+		"InvalidState": {
+			reason:  "A published state that cannot be read should return a fatal result",
+			context: `{"sequencer.fn.crossplane.io/state":"app"}`,
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_FATAL,
+					Message:  "cannot read sequencer.fn.crossplane.io/state context key: json: cannot unmarshal string into Go value of type main.sequencingState",
+					Target:   &target,
+				},
+			},
+			wantResources: []string{"app", "network"},
 		},
 	}
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
 			f := &Function{log: logging.NewNopLogger()}
+			observed := map[string]*v1.Resource{}
+			for _, n := range tc.observed {
+				observed[n] = &v1.Resource{Resource: resource.MustStructJSON(mr(n))}
+			}
 			req := &v1.RunFunctionRequest{
 				Input: resource.MustStructObject(&v1beta1.Input{
+					Mode: v1beta1.ModeEnforce,
 					Rules: []v1beta1.SequencingRule{
-						{
-							Sequence:  []resource.Name{"first", "second"},
-							Condition: tc.condition,
-						},
+						{Name: "stack", Sequence: []resource.Name{"network", "app"}},
 					},
 				}),
 				Observed: &v1.State{
 					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
-					Resources: map[string]*v1.Resource{},
+					Resources: observed,
 				},
 				Desired: &v1.State{
 					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
 					Resources: map[string]*v1.Resource{
-						"first":  {Resource: resource.MustStructJSON(mr)},
-						"second": {Resource: resource.MustStructJSON(mr)},
+						"network": {Resource: resource.MustStructJSON(mr("network"))},
+						"app":     {Resource: resource.MustStructJSON(mr("app"))},
 					},
 				},
 			}
+			if tc.context != "" {
+				req.Context = resource.MustStructJSON(tc.context)
+			}
+			if tc.annotate {
+				req.Desired.Resources["network"] = &v1.Resource{Resource: resource.MustStructJSON(annotated)}
+			}
 			rsp, err := f.RunFunction(context.Background(), req)
 			if err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
-			if len(rsp.GetResults()) == 0 {
-				t.Fatal("expected at least one result")
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
 			}
-			if rsp.GetResults()[0].GetSeverity() != v1.Severity_SEVERITY_FATAL {
-				t.Errorf("%s: expected FATAL severity, got %s", tc.reason, rsp.GetResults()[0].GetSeverity())
+			got := slices.Sorted(maps.Keys(rsp.GetDesired().GetResources()))
+			if diff := cmp.Diff(tc.wantResources, got); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want resources, +got resources:\n%s", tc.reason, diff)
+			}
+			for n, r := range rsp.GetDesired().GetResources() {
+				if a := r.GetResource().GetFields()["metadata"].GetStructValue().GetFields()["annotations"]; a != nil {
+					t.Errorf("%s\nf.RunFunction(...): want no annotations on %s, got %v", tc.reason, n, a)
+				}
+			}
+		})
+	}
+}
+
+func TestRunFunctionResults(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr","creationTimestamp":"2024-01-01T00:00:00Z"}}`
+	mr := func(name string) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":%q}}`, name)
+	}
+	stack := v1beta1.SequencingRule{Name: "stack", Sequence: []resource.Name{"vpc", "app-.*"}}
+
+	cases := map[string]struct {
+		reason      string
+		rules       []v1beta1.SequencingRule
+		results     *v1beta1.Results
+		wantResults []*v1.Result
+	}{
+		"PerStepDeduplicated": {
+			reason: "Rules sharing a step and its predecessor should report the delay once",
+			rules:  []v1beta1.SequencingRule{stack, stack},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation of resource(s) matching "app-.*" because "vpc" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+		},
+		"PerRule": {
+			reason:  "The resources delayed by a rule should be summarized in a single result",
+			rules:   []v1beta1.SequencingRule{stack},
+			results: &v1beta1.Results{Aggregation: v1beta1.ResultAggregationPerRule},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation in sequence stack: 3 resource(s) waiting because "vpc" is not fully ready (0 of 1): app-1, app-2, app-3`,
+					Target:   &target,
+				},
+			},
+		},
+		"PerRuleMaxNames": {
+			reason:  "Summaries should list at most maxNames resources",
+			rules:   []v1beta1.SequencingRule{stack},
+			results: &v1beta1.Results{Aggregation: v1beta1.ResultAggregationPerRule, MaxNames: ptr.To[int32](2)},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation in sequence stack: 3 resource(s) waiting because "vpc" is not fully ready (0 of 1): app-1, app-2 and 1 more`,
+					Target:   &target,
+				},
+			},
+		},
+		"PerRuleCount": {
+			reason:  "Summaries should only count the resources with the Count verbosity",
+			rules:   []v1beta1.SequencingRule{stack},
+			results: &v1beta1.Results{Aggregation: v1beta1.ResultAggregationPerRule, Verbosity: v1beta1.ResultVerbosityCount},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation in sequence stack: 3 resource(s) waiting because "vpc" is not fully ready (0 of 1)`,
+					Target:   &target,
+				},
+			},
+		},
+		"PerRuleNothingWithheld": {
+			reason:  "A rule that withholds nothing should not report a summary",
+			rules:   []v1beta1.SequencingRule{stack, stack},
+			results: &v1beta1.Results{Aggregation: v1beta1.ResultAggregationPerRule},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_NORMAL,
+					Message:  `Delaying creation in sequence stack: 3 resource(s) waiting because "vpc" is not fully ready (0 of 1): app-1, app-2, app-3`,
+					Target:   &target,
+				},
+			},
+		},
+		"PerRuleTimeout": {
+			reason: "Timeouts should still be reported for each step",
+			rules: []v1beta1.SequencingRule{
+				{Name: "stack", Sequence: []resource.Name{"vpc", "app-.*"}, Timeout: "1s"},
+			},
+			results: &v1beta1.Results{Aggregation: v1beta1.ResultAggregationPerRule},
+			wantResults: []*v1.Result{
+				{
+					Severity: v1.Severity_SEVERITY_WARNING,
+					Message:  `Delaying creation of resource(s) matching "app-.*" because "vpc" is not fully ready (0 of 1) for more than 1s`,
+					Target:   &target,
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			desired := map[string]*v1.Resource{}
+			for _, n := range []string{"vpc", "app-1", "app-2", "app-3"} {
+				desired[n] = &v1.Resource{Resource: resource.MustStructJSON(mr(n))}
+			}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					Results: tc.results,
+					Rules:   tc.rules,
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: desired,
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResults, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionSequencingComplete(t *testing.T) {
+	target := v1.Target_TARGET_COMPOSITE
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+	mr := func(name string) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":%q}}`, name)
+	}
+
+	cases := map[string]struct {
+		reason        string
+		apps          int
+		results       *v1beta1.Results
+		wantCondition *v1.Condition
+	}{
+		"ListsAll": {
+			reason: "The condition should list every blocked resource up to the default maximum",
+			apps:   3,
+			wantCondition: &v1.Condition{
+				Type:    ConditionTypeSequencingComplete,
+				Status:  v1.Status_STATUS_CONDITION_FALSE,
+				Reason:  "WaitingOnPredecessors",
+				Message: ptr.To(`app-01, app-02, app-03 waiting because "vpc" is not fully ready (0 of 1)`),
+				Target:  &target,
+			},
+		},
+		"DefaultMaxNames": {
+			reason: "The condition should list at most ten blocked resources by default",
+			apps:   12,
+			wantCondition: &v1.Condition{
+				Type:    ConditionTypeSequencingComplete,
+				Status:  v1.Status_STATUS_CONDITION_FALSE,
+				Reason:  "WaitingOnPredecessors",
+				Message: ptr.To(`app-01, app-02, app-03, app-04, app-05, app-06, app-07, app-08, app-09, app-10 and 2 more waiting because "vpc" is not fully ready (0 of 1)`),
+				Target:  &target,
+			},
+		},
+		"MaxNames": {
+			reason:  "The condition should list at most maxNames blocked resources",
+			apps:    3,
+			results: &v1beta1.Results{MaxNames: ptr.To[int32](2)},
+			wantCondition: &v1.Condition{
+				Type:    ConditionTypeSequencingComplete,
+				Status:  v1.Status_STATUS_CONDITION_FALSE,
+				Reason:  "WaitingOnPredecessors",
+				Message: ptr.To(`app-01, app-02 and 1 more waiting because "vpc" is not fully ready (0 of 1)`),
+				Target:  &target,
+			},
+		},
+		"NoNames": {
+			reason:  "The condition should only count the blocked resources when maxNames is zero",
+			apps:    3,
+			results: &v1beta1.Results{MaxNames: ptr.To[int32](0)},
+			wantCondition: &v1.Condition{
+				Type:    ConditionTypeSequencingComplete,
+				Status:  v1.Status_STATUS_CONDITION_FALSE,
+				Reason:  "WaitingOnPredecessors",
+				Message: ptr.To(`3 resource(s) waiting because "vpc" is not fully ready (0 of 1)`),
+				Target:  &target,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			desired := map[string]*v1.Resource{"vpc": {Resource: resource.MustStructJSON(mr("vpc"))}}
+			for i := 1; i <= tc.apps; i++ {
+				n := fmt.Sprintf("app-%02d", i)
+				desired[n] = &v1.Resource{Resource: resource.MustStructJSON(mr(n))}
+			}
+			req := &v1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					Results: tc.results,
+					Rules:   []v1beta1.SequencingRule{{Sequence: []resource.Name{"vpc", "app-.*"}}},
+				}),
+				Observed: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+				},
+				Desired: &v1.State{
+					Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+					Resources: desired,
+				},
+			}
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got *v1.Condition
+			for _, c := range rsp.GetConditions() {
+				if c.GetType() == ConditionTypeSequencingComplete {
+					got = c
+				}
+			}
+			if diff := cmp.Diff(tc.wantCondition, got, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want condition, +got condition:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func BenchmarkRunFunction(b *testing.B) {
+	xr := `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+	mr := func(name string) string {
+		return fmt.Sprintf(`{"apiVersion":"example.org/v1","kind":"MR","metadata":{"name":%q},"status":{"conditions":[{"type":"Ready","status":"True"}]}}`, name)
+	}
+
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("Resources=%d", 4*n), func(b *testing.B) {
+			f := &Function{log: logging.NewNopLogger()}
+			desired := map[string]*v1.Resource{}
+			observed := map[string]*v1.Resource{}
+			for i := range n {
+				for _, kind := range []string{"network", "db", "cache", "app"} {
+					name := fmt.Sprintf("%s-%d", kind, i)
+					desired[name] = &v1.Resource{Resource: resource.MustStructJSON(mr(name)), Ready: v1.Ready_READY_TRUE}
+					// Only half of the resources exist, so that the rest are sequenced.
+					if i%2 == 0 {
+						observed[name] = &v1.Resource{Resource: resource.MustStructJSON(mr(name))}
+					}
+				}
+			}
+			in := resource.MustStructObject(&v1beta1.Input{
+				Rules: []v1beta1.SequencingRule{
+					{Sequence: []resource.Name{"network-.*", "db-.*", "app-.*"}},
+					{Sequence: []resource.Name{"network-.*", "cache-.*", "app-.*"}},
+				},
+			})
+
+			b.ResetTimer()
+			for range b.N {
+				// RunFunction modifies the desired state, so every run gets its own copy.
+				req := &v1.RunFunctionRequest{
+					Input: in,
+					Observed: &v1.State{
+						Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+						Resources: observed,
+					},
+					Desired: &v1.State{
+						Composite: &v1.Resource{Resource: resource.MustStructJSON(xr)},
+						Resources: maps.Clone(desired),
+					},
+				}
+				if _, err := f.RunFunction(context.Background(), req); err != nil {
+					b.Fatal(err)
+				}
 			}
 		})
 	}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"github.com/crossplane/function-sequencer/input/v1beta1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/crossplane/function-sdk-go/resource"
+)
+
+// step is a node in a sequencing graph.
+type step struct {
+	// patterns select the composed resources of the step. A step with several
+	// patterns is a stage: its resources are released together and it gates
+	// its successors as a unit.
+	patterns []pattern
+	// stage names a stage in result messages, e.g. "stage 2", or is empty if
+	// the step is not a stage.
+	stage string
+	// when is an optional CEL expression that bypasses the step when false.
+	when string
+	// readyWhen is an optional CEL expression that every observed resource
+	// matching the step must satisfy before its successors are created.
+	readyWhen string
+	// minReady is how many resources matching each pattern must be ready. All
+	// of them when nil.
+	minReady *intstr.IntOrString
+	// minMatches is how many resources must match each pattern. At least one
+	// when nil.
+	minMatches *int32
+	// soakDuration is how long resources matching the step must have been
+	// ready before its successors are created.
+	soakDuration time.Duration
+	// timeout is how long the step may block its successors before onTimeout
+	// applies. No timeout when zero.
+	timeout time.Duration
+	// onTimeout is what happens once the timeout has elapsed.
+	onTimeout v1beta1.TimeoutPolicy
+	// onError is what happens when the when or readyWhen expression cannot
+	// be evaluated.
+	onError v1beta1.ErrorPolicy
+}
+
+// newStep converts a step of the Input API.
+func newStep(s v1beta1.SequenceStep) (step, error) {
+	set := 0
+	for _, ok := range []bool{s.Resource != "", len(s.Resources) > 0, s.Selector != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return step{}, errors.New("exactly one of resource, resources and selector must be set on a step")
+	}
+	st := step{
+		patterns:   namePatterns(s.Resources...),
+		when:       s.When,
+		readyWhen:  s.ReadyWhen,
+		minReady:   s.MinReady,
+		minMatches: s.MinMatches,
+	}
+	if s.MinReady != nil {
+		// Scaling against 100 yields the count itself, or the percentage.
+		n, err := intstr.GetScaledValueFromIntOrPercent(s.MinReady, 100, true)
+		if err != nil {
+			return step{}, errors.Wrap(err, "invalid minReady")
+		}
+		if n < 0 || (s.MinReady.Type == intstr.String && n > 100) {
+			return step{}, errors.Errorf("invalid minReady %q: must be a non-negative count or a percentage of at most 100%%", s.MinReady)
+		}
+	}
+	switch {
+	case s.Resource != "":
+		st.patterns = namePatterns(s.Resource)
+	case s.Selector != nil:
+		sel := *s.Selector
+		if sel.APIVersion == "" && sel.Kind == "" && len(sel.MatchLabels) == 0 && len(sel.MatchAnnotations) == 0 {
+			return step{}, errors.New("at least one of apiVersion, kind, matchLabels and matchAnnotations must be set on a selector")
+		}
+		st.patterns = []pattern{{selector: &sel}}
+	}
+	if s.SoakDuration != "" {
+		d, err := time.ParseDuration(s.SoakDuration)
+		if err != nil {
+			return step{}, errors.Wrapf(err, "cannot parse soakDuration %q", s.SoakDuration)
+		}
+		st.soakDuration = d
+	}
+	if s.Timeout != "" {
+		d, err := time.ParseDuration(s.Timeout)
+		if err != nil {
+			return step{}, errors.Wrapf(err, "cannot parse timeout %q", s.Timeout)
+		}
+		st.timeout = d
+	}
+	st.onTimeout = s.OnTimeout
+	return st, nil
+}
+
+// String describes the step in result messages.
+func (s step) String() string {
+	if s.stage == "" {
+		return fmt.Sprintf("%q", s.patterns[0])
+	}
+	quoted := make([]string, len(s.patterns))
+	for i, p := range s.patterns {
+		quoted[i] = fmt.Sprintf("%q", p)
+	}
+	return fmt.Sprintf("%s (%s)", s.stage, strings.Join(quoted, ", "))
+}
+
+// created returns true if every pattern of the step names a resource that
+// already exists in the cluster.
+func (s step) created(observedComposed map[resource.Name]resource.ObservedComposed) bool {
+	for _, p := range s.patterns {
+		if p.selector != nil {
+			return false
+		}
+		if _, ok := observedComposed[p.name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// sequencingGraph is the dependency graph described by a SequencingRule.
+// A sequence is represented as a chain where every step depends on the one
+// before it.
+type sequencingGraph struct {
+	steps []step
+	// predecessors holds, for each step, the indices of the steps it directly
+	// depends on.
+	predecessors [][]int
+
+	desc string
+}
+
+// newSequencingGraph builds the dependency graph described by a rule. Steps
+// inherit the timeout settings of the rule unless they set their own, as well
+// as its error policy, and the graph is described by the name of the rule if
+// it has one.
+func newSequencingGraph(rule v1beta1.SequencingRule) (*sequencingGraph, error) {
+	g, err := newRuleGraph(rule)
+	if err != nil {
+		return nil, err
+	}
+	if rule.Name != "" {
+		g.desc = rule.Name
+	}
+	var timeout time.Duration
+	if rule.Timeout != "" {
+		if timeout, err = time.ParseDuration(rule.Timeout); err != nil {
+			return nil, errors.Wrapf(err, "cannot parse timeout %q", rule.Timeout)
+		}
+	}
+	for i := range g.steps {
+		if g.steps[i].timeout == 0 {
+			g.steps[i].timeout = timeout
+		}
+		if g.steps[i].onTimeout == "" {
+			g.steps[i].onTimeout = rule.OnTimeout
+		}
+		if g.steps[i].onTimeout == "" {
+			g.steps[i].onTimeout = v1beta1.TimeoutPolicyWarn
+		}
+		g.steps[i].onError = rule.OnError
+	}
+	return g, nil
+}
+
+// newRuleGraph builds the graph of whichever form the rule is written in.
+func newRuleGraph(rule v1beta1.SequencingRule) (*sequencingGraph, error) {
+	forms := 0
+	for _, set := range []bool{len(rule.Sequence) > 0, len(rule.Steps) > 0, len(rule.Dependencies) > 0} {
+		if set {
+			forms++
+		}
+	}
+	if forms > 1 {
+		return nil, errors.New("sequence, steps and dependencies are mutually exclusive")
+	}
+	switch {
+	case len(rule.Dependencies) > 0:
+		return newDependencyGraph(rule.Dependencies)
+	case len(rule.Steps) > 0:
+		return newStepsGraph(rule.Steps)
+	}
+	steps := make([]v1beta1.SequenceStep, len(rule.Sequence))
+	for i, r := range rule.Sequence {
+		steps[i] = v1beta1.SequenceStep{Resource: r}
+	}
+	return newStepsGraph(steps)
+}
+
+// newStepsGraph builds a chain from a linear sequence of steps.
+func newStepsGraph(steps []v1beta1.SequenceStep) (*sequencingGraph, error) {
+	g := &sequencingGraph{}
+	desc := make([]string, len(steps))
+	for i, s := range steps {
+		st, err := newStep(s)
+		if err != nil {
+			return nil, err
+		}
+		desc[i] = st.patterns[0].String()
+		if len(s.Resources) > 0 {
+			st.stage = fmt.Sprintf("stage %d", i+1)
+			desc[i] = "{" + joinNames(s.Resources, " ") + "}"
+		}
+		g.steps = append(g.steps, st)
+		if i == 0 {
+			g.predecessors = append(g.predecessors, nil)
+			continue
+		}
+		g.predecessors = append(g.predecessors, []int{i - 1})
+	}
+	g.desc = fmt.Sprintf("%v", desc)
+	return g, nil
+}
+
+// newDependencyGraph builds a graph from a list of dependencies. Steps are
+// identified by their pattern, so a pattern that appears in several entries
+// refers to the same step. Selectors are identified by their description.
+// The settings of a step are taken from the entry that declares it as its
+// resource. An entry listing several resources declares the same
+// dependencies for each of them.
+func newDependencyGraph(deps []v1beta1.Dependency) (*sequencingGraph, error) {
+	g := &sequencingGraph{}
+	index := map[string]int{}
+	stepFor := func(p pattern) int {
+		if i, ok := index[p.String()]; ok {
+			return i
+		}
+		index[p.String()] = len(g.steps)
+		g.steps = append(g.steps, step{patterns: []pattern{p}})
+		g.predecessors = append(g.predecessors, nil)
+		return index[p.String()]
+	}
+
+	desc := make([]string, 0, len(deps))
+	for _, d := range deps {
+		st, err := newStep(d.SequenceStep)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range st.patterns {
+			i := stepFor(r)
+			g.steps[i] = st
+			g.steps[i].patterns = []pattern{r}
+			for _, before := range namePatterns(d.DependsOn...) {
+				p := stepFor(before)
+				if !slices.Contains(g.predecessors[i], p) {
+					g.predecessors[i] = append(g.predecessors[i], p)
+				}
+			}
+		}
+		desc = append(desc, fmt.Sprintf("%s -> %s", joinNames(d.DependsOn, ","), joinPatterns(st.patterns, ",")))
+	}
+	g.desc = "[" + strings.Join(desc, "; ") + "]"
+	return g, nil
+}
+
+// setsStalledCondition returns true if a step of the graph sets the
+// SequencingStalled condition when it times out.
+func (g *sequencingGraph) setsStalledCondition() bool {
+	return slices.ContainsFunc(g.steps, func(s step) bool {
+		return s.timeout > 0 && s.onTimeout == v1beta1.TimeoutPolicySetCondition
+	})
+}
+
+// String describes the graph in result messages.
+func (g *sequencingGraph) String() string {
+	return g.desc
+}
+
+// order returns the steps in topological order. Steps that do not depend on
+// each other keep their declaration order.
+func (g *sequencingGraph) order() ([]int, error) {
+	inDegree := make([]int, len(g.steps))
+	successors := make([][]int, len(g.steps))
+	for i, preds := range g.predecessors {
+		inDegree[i] = len(preds)
+		for _, p := range preds {
+			successors[p] = append(successors[p], i)
+		}
+	}
+
+	order := make([]int, 0, len(g.steps))
+	done := make([]bool, len(g.steps))
+	for len(order) < len(g.steps) {
+		next := -1
+		for i := range g.steps {
+			if !done[i] && inDegree[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return nil, errors.Errorf("dependencies %s contain a cycle", g)
+		}
+		done[next] = true
+		order = append(order, next)
+		for _, s := range successors[next] {
+			inDegree[s]--
+		}
+	}
+	return order, nil
+}
+
+// without returns a copy of the graph without the removed steps. Successors
+// of a removed step depend on its predecessors instead, so that the ordering
+// across the gap is preserved.
+func (g *sequencingGraph) without(removed []bool) *sequencingGraph {
+	effective := make([][]int, len(g.steps))
+	done := make([]bool, len(g.steps))
+	var resolve func(int) []int
+	resolve = func(i int) []int {
+		if done[i] {
+			return effective[i]
+		}
+		preds := []int{}
+		for _, p := range g.predecessors[i] {
+			if !removed[p] {
+				preds = append(preds, p)
+				continue
+			}
+			for _, pp := range resolve(p) {
+				if !slices.Contains(preds, pp) {
+					preds = append(preds, pp)
+				}
+			}
+		}
+		effective[i], done[i] = preds, true
+		return preds
+	}
+
+	index := make([]int, len(g.steps))
+	kept := &sequencingGraph{desc: g.desc}
+	for i, s := range g.steps {
+		if removed[i] {
+			continue
+		}
+		index[i] = len(kept.steps)
+		kept.steps = append(kept.steps, s)
+	}
+	for i := range g.steps {
+		if removed[i] {
+			continue
+		}
+		preds := []int{}
+		for _, p := range resolve(i) {
+			preds = append(preds, index[p])
+		}
+		kept.predecessors = append(kept.predecessors, preds)
+	}
+	return kept
+}
+
+// edge is a direct dependency between two steps of a graph.
+type edge struct {
+	// from is the step that must be ready first.
+	from int
+	// to is the step that depends on from.
+	to int
+}
+
+// edges returns every direct dependency in the graph.
+func (g *sequencingGraph) edges() []edge {
+	edges := []edge{}
+	for i, preds := range g.predecessors {
+		for _, p := range preds {
+			edges = append(edges, edge{from: p, to: i})
+		}
+	}
+	return edges
+}
+
+// ancestors returns every step that the given step depends on, directly or
+// transitively, following the supplied topological order.
+func (g *sequencingGraph) ancestors(i int, order []int) []int {
+	seen := make([]bool, len(g.steps))
+	var visit func(int)
+	visit = func(n int) {
+		for _, p := range g.predecessors[n] {
+			if !seen[p] {
+				seen[p] = true
+				visit(p)
+			}
+		}
+	}
+	visit(i)
+
+	ancestors := []int{}
+	for _, n := range order {
+		if seen[n] {
+			ancestors = append(ancestors, n)
+		}
+	}
+	return ancestors
+}
+
+func joinNames(names []resource.Name, sep string) string {
+	s := make([]string, len(names))
+	for i, n := range names {
+		s[i] = string(n)
+	}
+	return strings.Join(s, sep)
+}
+
+func joinPatterns(patterns []pattern, sep string) string {
+	s := make([]string, len(patterns))
+	for i, p := range patterns {
+		s[i] = p.String()
+	}
+	return strings.Join(s, sep)
+}
+
+// detectCycles builds the combined ordering graph of every rule and returns an
+// error naming the first cycle it finds. Cycles are searched for between the
+// rule patterns first, then between the desired composed resources the
+// patterns expand to, which catches contradictions that only appear once
+// regexes are matched against resource names.
+func detectCycles(graphs []*sequencingGraph, idx *matchIndex) error {
+	patterns := newDirectedGraph()
+	for _, g := range graphs {
+		for _, e := range g.edges() {
+			for _, from := range g.steps[e.from].patterns {
+				for _, to := range g.steps[e.to].patterns {
+					patterns.addEdge(from.String(), to.String())
+				}
+			}
+		}
+	}
+	if cycle := patterns.findCycle(); cycle != nil {
+		return errors.Errorf("sequencing rules contain a cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	matching := func(p pattern) ([]string, error) {
+		names, err := idx.desired(p)
+		if err != nil {
+			return nil, err
+		}
+		m := make([]string, len(names))
+		for i, n := range names {
+			m[i] = string(n)
+		}
+		return m, nil
+	}
+
+	resources := newDirectedGraph()
+	for gi, g := range graphs {
+		for _, e := range g.edges() {
+			from, err := g.steps[e.from].matching(matching)
+			if err != nil {
+				return err
+			}
+			to, err := g.steps[e.to].matching(matching)
+			if err != nil {
+				return err
+			}
+			// Every resource matching the predecessor precedes every resource
+			// matching the successor. Route these dependencies through a
+			// junction node so that the number of edges grows with the number
+			// of matches rather than with their product.
+			junction := fmt.Sprintf("%s%d/%d/%d", junctionPrefix, gi, e.from, e.to)
+			for _, f := range from {
+				resources.addEdge(f, junction)
+			}
+			for _, t := range to {
+				resources.addEdge(junction, t)
+			}
+		}
+	}
+	if cycle := resources.findCycle(); cycle != nil {
+		return errors.Errorf("sequencing rules contain a cycle between desired resources: %s", strings.Join(withoutJunctions(cycle), " -> "))
+	}
+	return nil
+}
+
+// junctionPrefix starts the names of the junction nodes detectCycles adds to
+// the graph of desired resources. Composition resource names never contain
+// it.
+const junctionPrefix = "\x00junction/"
+
+// withoutJunctions removes the junction nodes from a cycle, keeping it
+// closed.
+func withoutJunctions(cycle []string) []string {
+	out := []string{}
+	for _, n := range cycle[:len(cycle)-1] {
+		if !strings.HasPrefix(n, junctionPrefix) {
+			out = append(out, n)
+		}
+	}
+	return append(out, out[0])
+}
+
+// matching returns the union of the names matching each pattern of the step.
+func (s step) matching(match func(pattern) ([]string, error)) ([]string, error) {
+	names := []string{}
+	for _, p := range s.patterns {
+		m, err := match(p)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, m...)
+	}
+	return names, nil
+}
+
+// directedGraph is a simple graph of named nodes used to search for cycles.
+type directedGraph struct {
+	nodes []string
+	edges map[string][]string
+	seen  map[[2]string]bool
+}
+
+func newDirectedGraph() *directedGraph {
+	return &directedGraph{edges: map[string][]string{}, seen: map[[2]string]bool{}}
+}
+
+func (g *directedGraph) addNode(n string) {
+	if _, ok := g.edges[n]; !ok {
+		g.nodes = append(g.nodes, n)
+		g.edges[n] = nil
+	}
+}
+
+func (g *directedGraph) addEdge(from, to string) {
+	g.addNode(from)
+	g.addNode(to)
+	if !g.seen[[2]string{from, to}] {
+		g.seen[[2]string{from, to}] = true
+		g.edges[from] = append(g.edges[from], to)
+	}
+}
+
+// findCycle returns the path of the first cycle found, starting and ending
+// with the same node, or nil if the graph is acyclic.
+func (g *directedGraph) findCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(g.nodes))
+	path := []string{}
+
+	var visit func(n string) []string
+	visit = func(n string) []string {
+		state[n] = visiting
+		path = append(path, n)
+		for _, next := range g.edges[n] {
+			switch state[next] {
+			case visiting:
+				start := slices.Index(path, next)
+				return append(slices.Clone(path[start:]), next)
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[n] = visited
+		return nil
+	}
+
+	for _, n := range g.nodes {
+		if state[n] != unvisited {
+			continue
+		}
+		if cycle := visit(n); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
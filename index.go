@@ -0,0 +1,155 @@
+package main
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/crossplane/function-sdk-go/resource"
+)
+
+// patternKey identifies a pattern in a matchIndex. Name patterns and selectors
+// are kept apart so that a regex never collides with a selector description.
+type patternKey struct {
+	name     resource.Name
+	selector string
+}
+
+// key returns the key of the pattern in a matchIndex.
+func (p pattern) key() patternKey {
+	if p.selector == nil {
+		return patternKey{name: p.name}
+	}
+	return patternKey{selector: p.String()}
+}
+
+// patternMatches are the composed resources matching a pattern, sorted by
+// name.
+type patternMatches struct {
+	desired  []resource.Name
+	observed []resource.Name
+}
+
+// matchIndex records which composed resources every pattern of a request
+// matches, so that each pattern is compiled and matched against the composed
+// resources only once per request.
+//
+// The index is built before creation sequencing removes resources from the
+// desired state. Lookups of desired resources skip the ones removed since.
+type matchIndex struct {
+	desiredComposed  map[resource.Name]*resource.DesiredComposed
+	observedComposed map[resource.Name]resource.ObservedComposed
+
+	desiredNames  []resource.Name
+	observedNames []resource.Name
+	matches       map[patternKey]patternMatches
+}
+
+// newMatchIndex returns an empty index of the supplied composed resources.
+func newMatchIndex(
+	desiredComposed map[resource.Name]*resource.DesiredComposed,
+	observedComposed map[resource.Name]resource.ObservedComposed,
+) *matchIndex {
+	return &matchIndex{
+		desiredComposed:  desiredComposed,
+		observedComposed: observedComposed,
+		desiredNames:     slices.Sorted(maps.Keys(desiredComposed)),
+		observedNames:    slices.Sorted(maps.Keys(observedComposed)),
+		matches:          map[patternKey]patternMatches{},
+	}
+}
+
+// addGraphs indexes every pattern that takes part in a dependency of the
+// supplied graphs.
+func (idx *matchIndex) addGraphs(graphs ...*sequencingGraph) error {
+	for _, g := range graphs {
+		for _, e := range g.edges() {
+			for _, s := range []int{e.from, e.to} {
+				for _, p := range g.steps[s].patterns {
+					if _, err := idx.match(p); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// match returns the composed resources matching the pattern, indexing it first
+// if necessary.
+func (idx *matchIndex) match(p pattern) (patternMatches, error) {
+	if m, ok := idx.matches[p.key()]; ok {
+		return m, nil
+	}
+	pm, err := p.compile()
+	if err != nil {
+		return patternMatches{}, err
+	}
+	m := patternMatches{desired: []resource.Name{}, observed: []resource.Name{}}
+	for _, n := range idx.desiredNames {
+		if pm.matches(n, &idx.desiredComposed[n].Resource.Unstructured) {
+			m.desired = append(m.desired, n)
+		}
+	}
+	for _, n := range idx.observedNames {
+		if pm.matches(n, composedObject(n, idx.desiredComposed, idx.observedComposed)) {
+			m.observed = append(m.observed, n)
+		}
+	}
+	idx.matches[p.key()] = m
+	return m, nil
+}
+
+// desired returns the desired composed resources matching the pattern that
+// have not been removed from the desired state.
+func (idx *matchIndex) desired(p pattern) ([]resource.Name, error) {
+	m, err := idx.match(p)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]resource.Name, 0, len(m.desired))
+	for _, n := range m.desired {
+		if _, ok := idx.desiredComposed[n]; ok {
+			names = append(names, n)
+		}
+	}
+	return names, nil
+}
+
+// observed returns the observed composed resources matching the pattern.
+func (idx *matchIndex) observed(p pattern) ([]resource.Name, error) {
+	m, err := idx.match(p)
+	if err != nil {
+		return nil, err
+	}
+	return m.observed, nil
+}
+
+// matched returns every desired composed resource matching the pattern,
+// including those removed from the desired state since the index was built.
+func (idx *matchIndex) matched(p pattern) ([]resource.Name, error) {
+	m, err := idx.match(p)
+	if err != nil {
+		return nil, err
+	}
+	return m.desired, nil
+}
+
+// matchedBy returns the desired composed resources matching any pattern of
+// the graph, including those removed from the desired state since the index
+// was built.
+func (idx *matchIndex) matchedBy(g *sequencingGraph) (map[resource.Name]bool, error) {
+	names := map[resource.Name]bool{}
+	for _, s := range g.steps {
+		for _, p := range s.patterns {
+			m, err := idx.matched(p)
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range m {
+				names[n] = true
+			}
+		}
+	}
+	return names, nil
+}
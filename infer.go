@@ -0,0 +1,384 @@
+package main
+
+import (
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	apiextensionsv1beta1 "github.com/crossplane/crossplane/apis/v2/apiextensions/v1beta1"
+	protectionv1beta1 "github.com/crossplane/crossplane/apis/v2/protection/v1beta1"
+	"github.com/crossplane/function-sequencer/input/v1beta1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	v1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// objectReference identifies the composed resources a Usage or a managed
+// resource reference points at, either by name or by labels.
+type objectReference struct {
+	apiVersion string
+	kind       string
+	// kindHint is the lower-cased name of the kind a managed resource
+	// reference field points at, derived from the name of the field. The kind
+	// of a referenced resource must be a suffix of it.
+	kindHint    string
+	name        string
+	matchLabels map[string]string
+}
+
+// inferUsageDependencies derives creation dependencies from the Usage and
+// ClusterUsage resources already present in the desired state. The resource a
+// Usage is "of" must be ready before the resource it is "by" is created.
+func inferUsageDependencies(
+	desiredComposed map[resource.Name]*resource.DesiredComposed,
+	observedComposed map[resource.Name]resource.ObservedComposed,
+) ([]v1beta1.Dependency, [][]resource.Name) {
+	edges := map[resource.Name][]resource.Name{}
+	for _, name := range slices.Sorted(maps.Keys(desiredComposed)) {
+		u := &desiredComposed[name].Resource.Unstructured
+		if !isUsageObject(u) {
+			continue
+		}
+		of, ok := usageReference(u, "of")
+		if !ok {
+			continue
+		}
+		by, ok := usageReference(u, "by")
+		if !ok {
+			// A Usage without "by" only protects a resource from deletion.
+			continue
+		}
+		before := resolveReference(of, desiredComposed, observedComposed)
+		if len(before) == 0 {
+			continue
+		}
+		for _, r := range resolveReference(by, desiredComposed, observedComposed) {
+			edges[r] = append(edges[r], before...)
+		}
+	}
+	return acyclicDependencies(edges)
+}
+
+// annotationDependencies reads the creation dependencies that earlier pipeline
+// steps declared on the desired composed resources with the depends-on
+// annotation, a comma-separated list of composition resource names or regexes.
+func annotationDependencies(desiredComposed map[resource.Name]*resource.DesiredComposed) []v1beta1.Dependency {
+	deps := []v1beta1.Dependency{}
+	for _, name := range slices.Sorted(maps.Keys(desiredComposed)) {
+		value, ok := desiredComposed[name].Resource.GetAnnotations()[DependsOnAnnotation]
+		if !ok {
+			continue
+		}
+		d := v1beta1.Dependency{SequenceStep: v1beta1.SequenceStep{Resource: resource.Name(regexp.QuoteMeta(string(name)))}}
+		for p := range strings.SplitSeq(value, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				d.DependsOn = append(d.DependsOn, resource.Name(p))
+			}
+		}
+		if len(d.DependsOn) > 0 {
+			deps = append(deps, d)
+		}
+	}
+	return deps
+}
+
+// removeAnnotation removes an annotation meant for this function from the
+// desired composed resources, so that it never reaches the cluster.
+func removeAnnotation(desiredComposed map[resource.Name]*resource.DesiredComposed, key string) {
+	for _, d := range desiredComposed {
+		a := d.Resource.GetAnnotations()
+		if _, ok := a[key]; !ok {
+			continue
+		}
+		delete(a, key)
+		if len(a) == 0 {
+			a = nil
+		}
+		d.Resource.SetAnnotations(a)
+	}
+}
+
+// ignoredReferences are reference fields that do not express a creation
+// dependency on the referenced object.
+var ignoredReferences = map[string]bool{ //nolint:gochecknoglobals // read-only lookup table
+	// The connection secret is written by the resource, not read by it.
+	"writeConnectionSecretToRef": true,
+}
+
+// inferReferenceDependencies derives creation dependencies from the
+// cross-resource references of the desired composed resources, such as
+// spec.forProvider.vpcIdRef.name or spec.forProvider.subnetIdSelector.matchLabels.
+// A referenced resource must be ready before the resource referencing it is
+// created.
+func inferReferenceDependencies(
+	desiredComposed map[resource.Name]*resource.DesiredComposed,
+	observedComposed map[resource.Name]resource.ObservedComposed,
+) ([]v1beta1.Dependency, [][]resource.Name) {
+	edges := map[resource.Name][]resource.Name{}
+	for _, name := range slices.Sorted(maps.Keys(desiredComposed)) {
+		u := &desiredComposed[name].Resource.Unstructured
+		if isUsageObject(u) {
+			continue
+		}
+		spec, ok := u.Object["spec"].(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, ref := range findReferences(spec) {
+			edges[name] = append(edges[name], resolveReference(ref, desiredComposed, observedComposed)...)
+		}
+	}
+	return acyclicDependencies(edges)
+}
+
+// acyclicDependencies turns inferred edges, from each resource to the
+// resources that must be ready before it, into dependencies. Edges between
+// resources that depend on each other, directly or through others, are
+// dropped, since inferring them would only make sequencing impossible. It
+// also returns the sorted names of each such group of resources.
+func acyclicDependencies(edges map[resource.Name][]resource.Name) ([]v1beta1.Dependency, [][]resource.Name) {
+	components := stronglyConnected(edges)
+	cycles := [][]resource.Name{}
+	for _, c := range components {
+		if len(c) > 1 {
+			cycles = append(cycles, c)
+		}
+	}
+	component := map[resource.Name]int{}
+	for i, c := range components {
+		for _, n := range c {
+			component[n] = i
+		}
+	}
+	deps := []v1beta1.Dependency{}
+	for _, name := range slices.Sorted(maps.Keys(edges)) {
+		before := []resource.Name{}
+		for _, b := range edges[name] {
+			if b != name && component[b] != component[name] && !slices.Contains(before, b) {
+				before = append(before, b)
+			}
+		}
+		if len(before) > 0 {
+			deps = addDependency(deps, name, before)
+		}
+	}
+	slices.SortFunc(cycles, func(a, b []resource.Name) int { return strings.Compare(string(a[0]), string(b[0])) })
+	return deps, cycles
+}
+
+// warnInferredCycles reports each group of resources whose dependencies on
+// each other, inferred from the named source, were dropped.
+func warnInferredCycles(rsp *v1.RunFunctionResponse, source string, cycles [][]resource.Name) {
+	for _, c := range cycles {
+		names := make([]string, len(c))
+		for i, n := range c {
+			names[i] = string(n)
+		}
+		response.Warning(rsp, errors.Errorf("Ignoring dependencies inferred from %s between resources %s, because they depend on each other", source, strings.Join(names, ", ")))
+	}
+}
+
+// stronglyConnected returns the strongly connected components of the graph
+// described by edges, using Tarjan's algorithm. The names of each component
+// are sorted.
+func stronglyConnected(edges map[resource.Name][]resource.Name) [][]resource.Name {
+	index := map[resource.Name]int{}
+	low := map[resource.Name]int{}
+	onStack := map[resource.Name]bool{}
+	stack := []resource.Name{}
+	components := [][]resource.Name{}
+
+	var visit func(n resource.Name)
+	visit = func(n resource.Name) {
+		index[n] = len(index)
+		low[n] = index[n]
+		stack = append(stack, n)
+		onStack[n] = true
+		for _, m := range edges[n] {
+			if _, ok := index[m]; !ok {
+				visit(m)
+				low[n] = min(low[n], low[m])
+			} else if onStack[m] {
+				low[n] = min(low[n], index[m])
+			}
+		}
+		if low[n] != index[n] {
+			return
+		}
+		c := []resource.Name{}
+		for {
+			m := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[m] = false
+			c = append(c, m)
+			if m == n {
+				break
+			}
+		}
+		slices.Sort(c)
+		components = append(components, c)
+	}
+	for _, n := range slices.Sorted(maps.Keys(edges)) {
+		if _, ok := index[n]; !ok {
+			visit(n)
+		}
+	}
+	return components
+}
+
+// findReferences walks an object looking for managed resource reference and
+// selector fields. Fields named *Ref or *Refs reference objects by name and
+// fields named *Selector select them by labels.
+func findReferences(obj map[string]any) []objectReference {
+	refs := []objectReference{}
+	for _, k := range slices.Sorted(maps.Keys(obj)) {
+		if ignoredReferences[k] {
+			continue
+		}
+		switch v := obj[k].(type) {
+		case map[string]any:
+			switch {
+			case strings.HasSuffix(k, "Ref"):
+				if name, ok := v["name"].(string); ok && name != "" {
+					refs = append(refs, objectReference{kindHint: referencedKind(k), name: name})
+				}
+			case strings.HasSuffix(k, "Selector"):
+				if labels, _, _ := unstructured.NestedStringMap(v, "matchLabels"); len(labels) > 0 {
+					refs = append(refs, objectReference{kindHint: referencedKind(k), matchLabels: labels})
+				}
+			default:
+				refs = append(refs, findReferences(v)...)
+			}
+		case []any:
+			for _, e := range v {
+				m, ok := e.(map[string]any)
+				if !ok {
+					continue
+				}
+				if name, ok := m["name"].(string); ok && name != "" && strings.HasSuffix(k, "Refs") {
+					refs = append(refs, objectReference{kindHint: referencedKind(k), name: name})
+					continue
+				}
+				refs = append(refs, findReferences(m)...)
+			}
+		}
+	}
+	return refs
+}
+
+// referencedKind derives the lower-cased kind a reference or selector field
+// points at from its name, by trimming the Ref, Refs or Selector suffix and
+// the identifier the field resolves, e.g. "vpc" for vpcIdRef, "subnet" for
+// subnetIdSelector and "role" for roleArnRef.
+func referencedKind(field string) string {
+	for _, suffix := range []string{"Refs", "Ref", "Selector"} {
+		if base, ok := strings.CutSuffix(field, suffix); ok {
+			field = base
+			break
+		}
+	}
+	for _, suffix := range []string{"Ids", "Id", "Arns", "Arn", "Names", "Name"} {
+		if base, ok := strings.CutSuffix(field, suffix); ok && base != "" {
+			field = base
+			break
+		}
+	}
+	return strings.ToLower(field)
+}
+
+// usageReference reads the spec.of or spec.by reference of a Usage.
+func usageReference(u *unstructured.Unstructured, field string) (objectReference, bool) {
+	ref, found, err := unstructured.NestedMap(u.Object, "spec", field)
+	if err != nil || !found {
+		return objectReference{}, false
+	}
+	o := objectReference{}
+	o.apiVersion, _, _ = unstructured.NestedString(ref, "apiVersion")
+	o.kind, _, _ = unstructured.NestedString(ref, "kind")
+	o.name, _, _ = unstructured.NestedString(ref, "resourceRef", "name")
+	o.matchLabels, _, _ = unstructured.NestedStringMap(ref, "resourceSelector", "matchLabels")
+	return o, o.name != "" || len(o.matchLabels) > 0
+}
+
+// resolveReference returns the composition resource names of the desired
+// composed resources a reference points at. Names are compared against both
+// the desired and the observed resource, since the desired state usually
+// leaves metadata.name for Crossplane to generate. Resources of a kind other
+// than the one the reference points at never match, so that a selector does
+// not match every resource sharing its labels.
+func resolveReference(
+	ref objectReference,
+	desiredComposed map[resource.Name]*resource.DesiredComposed,
+	observedComposed map[resource.Name]resource.ObservedComposed,
+) []resource.Name {
+	matches := []resource.Name{}
+	for _, name := range slices.Sorted(maps.Keys(desiredComposed)) {
+		d := &desiredComposed[name].Resource.Unstructured
+		if isUsageObject(d) {
+			continue
+		}
+		if ref.apiVersion != "" && d.GetAPIVersion() != ref.apiVersion {
+			continue
+		}
+		if ref.kind != "" && d.GetKind() != ref.kind {
+			continue
+		}
+		if ref.kindHint != "" && !strings.HasSuffix(ref.kindHint, strings.ToLower(d.GetKind())) {
+			continue
+		}
+		candidates := []*unstructured.Unstructured{d}
+		if o, ok := observedComposed[name]; ok {
+			candidates = append(candidates, &o.Resource.Unstructured)
+		}
+		if slices.ContainsFunc(candidates, ref.matches) {
+			matches = append(matches, name)
+		}
+	}
+	return matches
+}
+
+// matches returns true if the supplied object is the one referenced.
+func (r objectReference) matches(u *unstructured.Unstructured) bool {
+	if r.name != "" {
+		return u.GetName() == r.name
+	}
+	return len(r.matchLabels) > 0 && containsAll(u.GetLabels(), r.matchLabels)
+}
+
+// addDependency records that the resource r depends on the resources in
+// before, merging with any dependency already recorded for r. Names are
+// quoted so they only ever match the resource they were inferred from.
+func addDependency(deps []v1beta1.Dependency, r resource.Name, before []resource.Name) []v1beta1.Dependency {
+	pattern := resource.Name(regexp.QuoteMeta(string(r)))
+	i := slices.IndexFunc(deps, func(d v1beta1.Dependency) bool { return d.Resource == pattern })
+	if i < 0 {
+		deps = append(deps, v1beta1.Dependency{SequenceStep: v1beta1.SequenceStep{Resource: pattern}})
+		i = len(deps) - 1
+	}
+	for _, b := range before {
+		if b == r {
+			continue
+		}
+		p := resource.Name(regexp.QuoteMeta(string(b)))
+		if !slices.Contains(deps[i].DependsOn, p) {
+			deps[i].DependsOn = append(deps[i].DependsOn, p)
+		}
+	}
+	return deps
+}
+
+// isUsageObject returns true if the object is a Usage or ClusterUsage of any
+// supported API version.
+func isUsageObject(u *unstructured.Unstructured) bool {
+	switch u.GetAPIVersion() {
+	case ProtectionV1GroupVersion:
+		return u.GetKind() == apiextensionsv1beta1.UsageKind
+	case ProtectionGroupVersion:
+		return u.GetKind() == protectionv1beta1.UsageKind || u.GetKind() == protectionv1beta1.ClusterUsageKind
+	}
+	return false
+}
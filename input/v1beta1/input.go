@@ -6,6 +6,7 @@ package v1beta1
 
 import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 
 	"github.com/crossplane/function-sdk-go/resource"
 )
@@ -13,11 +14,107 @@ import (
 // This isn't a custom resource, in the sense that we never install its CRD.
 // It is a KRM-like object, so we generate a CRD to describe its schema.
 
+// SequenceStep is an entry of a sequence with optional settings that control
+// when the resources it matches are considered ready by their successors.
+// +kubebuilder:validation:XValidation:rule="[has(self.resource), has(self.resources), has(self.selector)].filter(x, x).size() == 1",message="exactly one of resource, resources and selector must be set"
+type SequenceStep struct {
+	// Resource is a composition resource name or regex.
+	// +optional
+	Resource resource.Name `json:"resource,omitempty"`
+
+	// Resources is a stage of composition resource names or regexes that are released together.
+	// The next step waits until every pattern of the stage is ready, and in a sequence the step is
+	// reported as a stage in result messages. Mutually exclusive with Resource.
+	// +optional
+	Resources []resource.Name `json:"resources,omitempty"`
+
+	// Selector selects composed resources by the contents of the desired composed resource instead of by
+	// composition resource name. Mutually exclusive with Resource and Resources.
+	// +optional
+	Selector *ResourceSelector `json:"selector,omitempty"`
+
+	// When is a CEL expression evaluated against the function request. When set and evaluates to false, the step
+	// is bypassed: its resources are not sequenced, and its successors wait on the steps before it instead. The
+	// observed, desired and context variables are available.
+	// Example: observed.composite.resource.spec.cache.enabled == true
+	// +optional
+	When string `json:"when,omitempty"`
+
+	// ReadyWhen is a CEL expression evaluated against each observed resource matching this step, available as
+	// the self variable. Successors are not created until it evaluates to true for every matching resource, in
+	// addition to the resources being ready. The observed, desired and context variables are also available.
+	// Example: has(self.status.atProvider.endpoint) && self.status.atProvider.endpoint != ""
+	// +optional
+	ReadyWhen string `json:"readyWhen,omitempty"`
+
+	// MinReady is the number of resources matching this step that must be ready before successors are created,
+	// either as an absolute count (e.g. 3) or as a percentage of the matching resources, rounded up (e.g. "80%").
+	// Defaults to all matching resources.
+	// +optional
+	MinReady *intstr.IntOrString `json:"minReady,omitempty"`
+
+	// MinMatches is the number of desired resources that must match this step before successors are created.
+	// Defaults to 1.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MinMatches *int32 `json:"minMatches,omitempty"`
+
+	// SoakDuration is how long every resource matching this step must have been ready before successors are
+	// created, measured from the lastTransitionTime of its observed Ready condition, or from its creationTimestamp
+	// when it has none. Useful when an API reports Ready before dependent operations succeed reliably. Example: "2m".
+	// +optional
+	SoakDuration string `json:"soakDuration,omitempty"`
+
+	// Timeout is how long successors wait for this step to become ready before OnTimeout applies, measured
+	// from the lastTransitionTime of the Ready condition of its observed resources, or from when its
+	// predecessors became ready when none has been observed yet. Overrides the timeout of the rule. Example: "30m".
+	// +optional
+	Timeout string `json:"timeout,omitempty"`
+
+	// OnTimeout is what happens once Timeout has elapsed. Overrides the onTimeout of the rule.
+	// +optional
+	OnTimeout TimeoutPolicy `json:"onTimeout,omitempty"`
+}
+
+// ResourceSelector selects composed resources by their API version, kind, labels or annotations. A resource
+// must match every field that is set.
+// +kubebuilder:validation:XValidation:rule="has(self.apiVersion) || has(self.kind) || has(self.matchLabels) || has(self.matchAnnotations)",message="at least one of apiVersion, kind, matchLabels and matchAnnotations must be set"
+type ResourceSelector struct {
+	// APIVersion of the selected resources, e.g. ec2.aws.upbound.io/v1beta1. The version may be omitted to
+	// select every version of an API group, e.g. ec2.aws.upbound.io.
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// Kind of the selected resources, e.g. Subnet.
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// MatchLabels are labels the selected resources must have.
+	// +optional
+	MatchLabels map[string]string `json:"matchLabels,omitempty"`
+
+	// MatchAnnotations are annotations the selected resources must have.
+	// +optional
+	MatchAnnotations map[string]string `json:"matchAnnotations,omitempty"`
+}
+
+// Dependency declares the resources a composition resource depends on.
+type Dependency struct {
+	SequenceStep `json:",inline"`
+
+	// DependsOn is a list of composition resource names or regexes that must
+	// be ready before the resources matching Resource are created.
+	// +optional
+	DependsOn []resource.Name `json:"dependsOn,omitempty"`
+}
+
 // SequencingRule is a rule that describes a sequence of resources.
 // +kubebuilder:validation:XValidation:rule="!(self.createOnly && self.deleteOnly)",message="createOnly and deleteOnly are mutually exclusive"
+// +kubebuilder:validation:XValidation:rule="[has(self.sequence), has(self.steps), has(self.dependencies)].filter(x, x).size() <= 1",message="sequence, steps and dependencies are mutually exclusive"
 type SequencingRule struct {
-	// TODO: Should we add a way to infer sequencing from usages? e.g. InferFromUsages: true
-	// InferFromUsages bool            `json:"inferFromUsages,omitempty"`
+	// Name identifies the rule in result messages instead of its list of resources.
+	// +optional
+	Name string `json:"name,omitempty"`
 
 	// Condition is a CEL expression evaluated against the function request state.
 	// When set and evaluates to false, the entire sequence is skipped for creation
@@ -38,8 +135,41 @@ type SequencingRule struct {
 	// +optional
 	DeleteOnly bool `json:"deleteOnly,omitempty"`
 
+	// Dependencies describes a dependency graph of composition resources.
+	// Each entry names a resource and the resources it depends on, allowing
+	// orderings that cannot be expressed as a single linear sequence.
+	// Mutually exclusive with Sequence and Steps.
+	// +optional
+	Dependencies []Dependency `json:"dependencies,omitempty"`
+
 	// Sequence is a list of composition resource names.
 	Sequence []resource.Name `json:"sequence,omitempty"`
+
+	// Steps is a sequence of composition resources where each entry can carry additional settings.
+	// Mutually exclusive with Sequence and Dependencies.
+	// +optional
+	Steps []SequenceStep `json:"steps,omitempty"`
+
+	// PairCaptureGroups pairs the resources of consecutive steps by the capture groups of their regexes.
+	// The capture groups of a step's regex are substituted for $N references in the pattern of its successors,
+	// so with the steps db-(.*) and app-$1, app-foo only waits for db-foo and Usages are only generated between
+	// paired resources. Every step must be a single resource name or regex.
+	// +optional
+	PairCaptureGroups bool `json:"pairCaptureGroups,omitempty"`
+
+	// Timeout is how long successors wait for any step of this rule to become ready before OnTimeout applies.
+	// Steps can override it. Example: "30m".
+	// +optional
+	Timeout string `json:"timeout,omitempty"`
+
+	// OnTimeout is what happens once Timeout has elapsed. Defaults to Warn.
+	// +optional
+	OnTimeout TimeoutPolicy `json:"onTimeout,omitempty"`
+
+	// OnError is what happens when the condition of the rule, or the when or readyWhen expression of one of its
+	// steps, cannot be evaluated. Defaults to Fatal.
+	// +optional
+	OnError ErrorPolicy `json:"onError,omitempty"`
 }
 
 // UsageVersion defines the version of the Usage resource.
@@ -53,6 +183,130 @@ const (
 	UsageV2 UsageVersion = "v2"
 )
 
+// ReadinessSource defines where the readiness of a composed resource is read from.
+// +kubebuilder:validation:Enum=Desired;Observed;Both
+type ReadinessSource string
+
+const (
+	// ReadinessSourceDesired uses the readiness set on the desired composed resource by earlier pipeline steps,
+	// e.g. function-auto-ready.
+	ReadinessSourceDesired ReadinessSource = "Desired"
+
+	// ReadinessSourceObserved reads the Ready and Synced conditions of the observed composed resource.
+	ReadinessSourceObserved ReadinessSource = "Observed"
+
+	// ReadinessSourceBoth requires a resource to be ready according to both the desired and the observed state.
+	ReadinessSourceBoth ReadinessSource = "Both"
+)
+
+// TimeoutPolicy defines what happens when a step has blocked its successors for longer than its timeout.
+// +kubebuilder:validation:Enum=Warn;SetCondition;Proceed;Fatal
+type TimeoutPolicy string
+
+const (
+	// TimeoutPolicyWarn keeps delaying the successors and reports the stall as a Warning result.
+	TimeoutPolicyWarn TimeoutPolicy = "Warn"
+
+	// TimeoutPolicySetCondition keeps delaying the successors and sets the SequencingStalled condition on the
+	// composite.
+	TimeoutPolicySetCondition TimeoutPolicy = "SetCondition"
+
+	// TimeoutPolicyProceed creates the successors anyway and reports it as a Warning result.
+	TimeoutPolicyProceed TimeoutPolicy = "Proceed"
+
+	// TimeoutPolicyFatal returns a Fatal result, failing the composition pipeline.
+	TimeoutPolicyFatal TimeoutPolicy = "Fatal"
+)
+
+// ErrorPolicy defines what happens when a CEL expression cannot be evaluated, for example because it reads a
+// field the composite does not have yet.
+// +kubebuilder:validation:Enum=Fatal;TreatAsFalse;TreatAsTrue;Warn
+type ErrorPolicy string
+
+const (
+	// ErrorPolicyFatal returns a Fatal result, failing the composition pipeline.
+	ErrorPolicyFatal ErrorPolicy = "Fatal"
+
+	// ErrorPolicyTreatAsFalse treats the expression as false.
+	ErrorPolicyTreatAsFalse ErrorPolicy = "TreatAsFalse"
+
+	// ErrorPolicyTreatAsTrue treats the expression as true.
+	ErrorPolicyTreatAsTrue ErrorPolicy = "TreatAsTrue"
+
+	// ErrorPolicyWarn treats the expression as false and reports the error as a Warning result.
+	ErrorPolicyWarn ErrorPolicy = "Warn"
+)
+
+// Mode defines what the function does with the desired composed resources.
+// +kubebuilder:validation:Enum=Sequence;Enforce
+type Mode string
+
+const (
+	// ModeSequence withholds desired composed resources until their predecessors are ready.
+	ModeSequence Mode = "Sequence"
+
+	// ModeEnforce is meant for the last step of the pipeline. It removes the resources an earlier step in Sequence
+	// mode withheld again, in case a later step added them back, and reports them as a Warning result. The
+	// Warning cannot name the pipeline step that added a resource back, since functions only see the desired state.
+	ModeEnforce Mode = "Enforce"
+)
+
+// ResultAggregation defines how results about delayed resources are reported.
+// +kubebuilder:validation:Enum=PerStep;PerRule
+type ResultAggregation string
+
+const (
+	// ResultAggregationPerStep reports every delayed step and the predecessor it waits on as a separate result.
+	ResultAggregationPerStep ResultAggregation = "PerStep"
+
+	// ResultAggregationPerRule reports a single summary of the resources delayed by each rule.
+	ResultAggregationPerRule ResultAggregation = "PerRule"
+)
+
+// ResultVerbosity defines how much detail aggregated results contain.
+// +kubebuilder:validation:Enum=Count;Names
+type ResultVerbosity string
+
+const (
+	// ResultVerbosityCount only reports how many resources wait on each predecessor.
+	ResultVerbosityCount ResultVerbosity = "Count"
+
+	// ResultVerbosityNames also lists the names of the resources waiting on each predecessor.
+	ResultVerbosityNames ResultVerbosity = "Names"
+)
+
+// Results configures the results reported about delayed resources.
+type Results struct {
+	// Aggregation is PerStep (the default) to report every delayed step and the predecessor it waits on, or
+	// PerRule to report a single summary for each rule, e.g.
+	// `Delaying creation in sequence stack: 3 resource(s) waiting because "vpc" is not fully ready (0 of 1): a, b, c`.
+	// Results about timeouts are always reported for each step.
+	// +kubebuilder:default:="PerStep"
+	// +optional
+	Aggregation ResultAggregation `json:"aggregation,omitempty"`
+
+	// Verbosity of the summaries reported with the PerRule aggregation. Names (the default) lists the waiting
+	// resources, Count only counts them.
+	// +kubebuilder:default:="Names"
+	// +optional
+	Verbosity ResultVerbosity `json:"verbosity,omitempty"`
+
+	// MaxNames is the maximum number of resource names listed for each predecessor with the Names verbosity, and
+	// in the message of the SequencingComplete condition. Defaults to 10.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxNames *int32 `json:"maxNames,omitempty"`
+}
+
+// SyncWave assigns composition resources to a sync wave.
+type SyncWave struct {
+	// Wave is the sync wave of the resources. Lower waves are created first, and may be negative.
+	Wave int32 `json:"wave"`
+
+	// Resources is a list of composition resource names or regexes in the wave.
+	Resources []resource.Name `json:"resources"`
+}
+
 // Input can be used to provide input to this Function.
 // +kubebuilder:object:root=true
 // +kubebuilder:storageversion
@@ -79,9 +333,60 @@ type Input struct {
 	// +kubebuilder:object:default="v2"
 	UsageVersion UsageVersion `json:"usageVersion,omitempty"`
 
+	// InferFromUsages derives creation sequencing from the Usage/ClusterUsage resources already present in the
+	// desired state, e.g. emitted by an earlier pipeline step. The resource a Usage is "of" must be ready before
+	// the resource it is "by" is created. Inferred rules never generate additional Usages.
+	// +kubebuilder:object:default=false
+	// +optional
+	InferFromUsages bool `json:"inferFromUsages,omitempty"`
+
+	// InferFromReferences derives creation sequencing from the cross-resource references of the desired composed
+	// resources. Fields named *Ref or *Refs are matched against the metadata.name of other desired composed
+	// resources and fields named *Selector are matched against their labels, considering only resources of the
+	// kind named by the field, e.g. VPC for vpcIdRef. A referenced resource must be ready before the resource
+	// referencing it is created. Dependencies between resources that reference each other are dropped.
+	// +kubebuilder:object:default=false
+	// +optional
+	InferFromReferences bool `json:"inferFromReferences,omitempty"`
+
+	// ReadinessSource controls how the readiness of predecessor resources is determined.
+	// Desired (the default) relies on an earlier pipeline step marking desired composed resources as ready.
+	// Observed reads the Ready and Synced conditions of the observed composed resources directly, so the
+	// function does not depend on its position in the pipeline. Both requires both sources to report ready.
+	// +kubebuilder:default:="Desired"
+	// +optional
+	ReadinessSource ReadinessSource `json:"readinessSource,omitempty"`
+
+	// Mode is Sequence (the default) to sequence the desired composed resources, or Enforce to remove the
+	// resources an earlier step in Sequence mode withheld again, in case a later pipeline step added them back.
+	// Enforce reads the resources to remove from the sequencer.fn.crossplane.io/state context key and, when no
+	// earlier step published it, sequences the desired composed resources again according to the rules. The
+	// Warning reporting a removed resource cannot name the pipeline step that added it back.
+	// +kubebuilder:default:="Sequence"
+	// +optional
+	Mode Mode `json:"mode,omitempty"`
+
+	// Waves assigns composition resources to sync waves, an alternative to listing sequences by hand.
+	// Resources can also set their wave with the sequencer.fn.crossplane.io/wave annotation, which takes
+	// precedence, and resources without a wave are in wave 0. No resource is created until every resource in
+	// the lower waves is ready, and deletion sequencing generates Usages between consecutive waves.
+	// +optional
+	Waves []SyncWave `json:"waves,omitempty"`
+
 	// ResetCompositeReadiness sets the composite ready state to false if desired resources are removed from the request.
 	// +kubebuilder:object:default=false
 	ResetCompositeReadiness bool `json:"resetCompositeReadiness,omitempty"`
+
+	// Results configures the results reported about delayed resources.
+	// +optional
+	Results *Results `json:"results,omitempty"`
+
+	// StatusField is a field of the composite status the function writes a report of its progress to, e.g.
+	// status.sequencer. For every rule the report lists the position of the first step that is not ready, how
+	// many resources matching each pattern are ready, the resources withheld and the Usages generated. No
+	// report is written when empty.
+	// +optional
+	StatusField string `json:"statusField,omitempty"`
 	// Rules is a list of rules that describe sequences of resources.
 	Rules []SequencingRule `json:"rules"`
 }
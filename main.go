@@ -2,6 +2,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/alecthomas/kong"
 
 	"github.com/crossplane/function-sdk-go"
@@ -16,6 +18,9 @@ type CLI struct {
 	TLSCertsDir        string `env:"TLS_SERVER_CERTS_DIR"                                                                           help:"Directory containing server certs (tls.key, tls.crt) and the CA used to verify client certificates (ca.crt)"`
 	Insecure           bool   `help:"Run without mTLS credentials. If you supply this flag --tls-server-certs-dir will be ignored."`
 	MaxRecvMessageSize int    `default:"4"                                                                                          help:"Maximum size of received messages in MB."`
+
+	CELCostLimit uint64        `default:"1000000" help:"Maximum cost of evaluating a CEL expression. Set to 0 to disable the limit." name:"cel-cost-limit"`
+	CELTimeout   time.Duration `default:"1s"      help:"Maximum time evaluating a CEL expression may take. Set to 0 to disable the timeout." name:"cel-timeout"`
 }
 
 // Run this Function.
@@ -25,7 +30,7 @@ func (c *CLI) Run() error {
 		return err
 	}
 
-	return function.Serve(&Function{log: log},
+	return function.Serve(&Function{log: log, celCostLimit: c.CELCostLimit, celTimeout: c.CELTimeout},
 		function.Listen(c.Network, c.Address),
 		function.MTLSCertificates(c.TLSCertsDir),
 		function.Insecure(c.Insecure),
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+
+	"github.com/crossplane/function-sdk-go/resource"
+)
+
+// captureGroupReference matches a reference to a capture group of the previous
+// step, written $1 or ${1}.
+var captureGroupReference = regexp.MustCompile(`\$(\d+|\{\d+\})`) //nolint:gochecknoglobals // compiled once
+
+// pairCaptureGroups expands the graph into a graph of the supplied composed
+// resources, where a resource only depends on the resources of its
+// predecessors that it is paired with. A resource matching a step is paired
+// with a resource matching a predecessor if it matches the pattern of the step
+// once the capture groups of the predecessor's regex, as matched against the
+// predecessor's resource, are substituted for its $N references. For example
+// app-foo is paired with db-foo, but not with db-bar, given the steps db-(.*)
+// and app-$1. A resource that is not paired with any resource of a predecessor
+// depends on the resource it would be paired with instead, so that it waits
+// for db-foo to exist rather than being created right away.
+func (g *sequencingGraph) pairCaptureGroups(names []resource.Name) (*sequencingGraph, error) {
+	type match struct {
+		name   resource.Name
+		groups []string
+	}
+	matches := make([][]match, len(g.steps))
+	for i, s := range g.steps {
+		if len(s.patterns) != 1 || s.patterns[0].selector != nil {
+			return nil, errors.New("pairCaptureGroups requires every step to be a single resource name or regex")
+		}
+		re, err := getStrictRegex(expandCaptureGroups(s.patterns[0].name, nil))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot compile regex %s", s.patterns[0].name)
+		}
+		for _, n := range names {
+			if groups := re.FindStringSubmatch(string(n)); groups != nil {
+				matches[i] = append(matches[i], match{name: n, groups: groups})
+			}
+		}
+	}
+
+	paired := &sequencingGraph{desc: g.desc}
+	index := make([]map[resource.Name]int, len(g.steps))
+	for i, s := range g.steps {
+		index[i] = map[resource.Name]int{}
+		for _, m := range matches[i] {
+			st := s
+			st.patterns = namePatterns(resource.Name(regexp.QuoteMeta(string(m.name))))
+			index[i][m.name] = len(paired.steps)
+			paired.steps = append(paired.steps, st)
+			paired.predecessors = append(paired.predecessors, nil)
+		}
+	}
+	// missing indexes the steps added for the unmatched predecessors of each
+	// step by their pattern.
+	missing := make([]map[resource.Name]int, len(g.steps))
+	for _, e := range g.edges() {
+		pairs := map[resource.Name]bool{}
+		for _, before := range matches[e.from] {
+			re, err := getStrictRegex(expandCaptureGroups(g.steps[e.to].patterns[0].name, before.groups))
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot compile regex %s", g.steps[e.to].patterns[0].name)
+			}
+			for _, after := range matches[e.to] {
+				if re.MatchString(string(after.name)) {
+					to := index[e.to][after.name]
+					paired.predecessors[to] = append(paired.predecessors[to], index[e.from][before.name])
+					pairs[after.name] = true
+				}
+			}
+		}
+		for _, after := range matches[e.to] {
+			if pairs[after.name] {
+				continue
+			}
+			p, err := pairedPattern(g.steps[e.from].patterns[0].name, g.steps[e.to].patterns[0].name, after.name)
+			if err != nil {
+				return nil, err
+			}
+			if missing[e.from] == nil {
+				missing[e.from] = map[resource.Name]int{}
+			}
+			from, ok := missing[e.from][p]
+			if !ok {
+				st := g.steps[e.from]
+				st.patterns = namePatterns(p)
+				from = len(paired.steps)
+				missing[e.from][p] = from
+				paired.steps = append(paired.steps, st)
+				paired.predecessors = append(paired.predecessors, nil)
+			}
+			to := index[e.to][after.name]
+			paired.predecessors[to] = append(paired.predecessors[to], from)
+		}
+	}
+	return paired, nil
+}
+
+// pairedPattern returns the pattern of the predecessor resource the named
+// resource would be paired with, by substituting the parts of its name matched
+// by the $N references of the pattern after for the capture groups of the
+// pattern before. For example db-foo for app-foo, given the steps db-(.*) and
+// app-$1. Capture groups the name does not determine are left as they are.
+func pairedPattern(before, after, name resource.Name) (resource.Name, error) {
+	named := map[string]bool{}
+	expr := captureGroupReference.ReplaceAllStringFunc(string(after), func(ref string) string {
+		n := strings.Trim(ref, "${}")
+		if named[n] {
+			return "(.*)"
+		}
+		named[n] = true
+		return "(?P<pair" + n + ">.*)"
+	})
+	re, err := getStrictRegex(expr)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot compile regex %s", after)
+	}
+	m := re.FindStringSubmatch(string(name))
+	groups := map[int]string{}
+	for i, sub := range re.SubexpNames() {
+		if n, ok := strings.CutPrefix(sub, "pair"); ok && m != nil {
+			if k, err := strconv.Atoi(n); err == nil {
+				groups[k] = m[i]
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return before, nil
+	}
+	parsed, err := syntax.Parse(string(before), syntax.Perl)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot parse regex %s", before)
+	}
+	substituteCaptureGroups(parsed, groups)
+	return resource.Name(parsed.String()), nil
+}
+
+// substituteCaptureGroups replaces the numbered capture groups of a parsed
+// regex with the supplied literals.
+func substituteCaptureGroups(re *syntax.Regexp, groups map[int]string) {
+	if v, ok := groups[re.Cap]; ok && re.Op == syntax.OpCapture {
+		*re = syntax.Regexp{Op: syntax.OpLiteral, Rune: []rune(v)}
+		return
+	}
+	for _, sub := range re.Sub {
+		substituteCaptureGroups(sub, groups)
+	}
+}
+
+// expandCaptureGroups substitutes the supplied capture groups for the $N
+// references of a pattern, quoting them so they only match literally. A
+// reference to a group that was not supplied matches anything.
+func expandCaptureGroups(pattern resource.Name, groups []string) string {
+	return captureGroupReference.ReplaceAllStringFunc(string(pattern), func(ref string) string {
+		n, err := strconv.Atoi(strings.Trim(ref, "${}"))
+		if err != nil || n >= len(groups) {
+			return "(.*)"
+		}
+		return regexp.QuoteMeta(groups[n])
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"github.com/crossplane/function-sequencer/input/v1beta1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/crossplane/function-sdk-go/resource"
+)
+
+// pattern selects the composed resources of a step, either by composition
+// resource name or by the contents of the desired composed resource.
+type pattern struct {
+	// name is a composition resource name or regex. Empty for selectors.
+	name resource.Name
+	// selector selects resources by API version, kind, labels or annotations.
+	selector *v1beta1.ResourceSelector
+}
+
+// namePatterns converts composition resource names or regexes to patterns.
+func namePatterns(names ...resource.Name) []pattern {
+	p := make([]pattern, len(names))
+	for i, n := range names {
+		p[i] = pattern{name: n}
+	}
+	return p
+}
+
+// String describes the pattern in result messages.
+func (p pattern) String() string {
+	if p.selector == nil {
+		return string(p.name)
+	}
+	parts := []string{}
+	if p.selector.APIVersion != "" {
+		parts = append(parts, "apiVersion="+p.selector.APIVersion)
+	}
+	if p.selector.Kind != "" {
+		parts = append(parts, "kind="+p.selector.Kind)
+	}
+	for _, k := range slices.Sorted(maps.Keys(p.selector.MatchLabels)) {
+		parts = append(parts, fmt.Sprintf("label %s=%s", k, p.selector.MatchLabels[k]))
+	}
+	for _, k := range slices.Sorted(maps.Keys(p.selector.MatchAnnotations)) {
+		parts = append(parts, fmt.Sprintf("annotation %s=%s", k, p.selector.MatchAnnotations[k]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// matcher matches composed resources against a compiled pattern.
+type matcher struct {
+	re       *regexp.Regexp
+	selector *v1beta1.ResourceSelector
+}
+
+// compile prepares the pattern for matching.
+func (p pattern) compile() (matcher, error) {
+	if p.selector != nil {
+		return matcher{selector: p.selector}, nil
+	}
+	re, err := getStrictRegex(string(p.name))
+	if err != nil {
+		return matcher{}, errors.Wrapf(err, "cannot compile regex %s", p.name)
+	}
+	return matcher{re: re}, nil
+}
+
+// matches returns true if the named composed resource matches the pattern.
+// Selectors are evaluated against the supplied object, which may be nil.
+func (m matcher) matches(name resource.Name, u *unstructured.Unstructured) bool {
+	if m.re != nil {
+		return m.re.MatchString(string(name))
+	}
+	if u == nil {
+		return false
+	}
+	if v := m.selector.APIVersion; v != "" && u.GetAPIVersion() != v {
+		// Allow selecting every version of an API group.
+		gv, err := schema.ParseGroupVersion(u.GetAPIVersion())
+		if err != nil || gv.Group != v {
+			return false
+		}
+	}
+	if m.selector.Kind != "" && u.GetKind() != m.selector.Kind {
+		return false
+	}
+	return containsAll(u.GetLabels(), m.selector.MatchLabels) && containsAll(u.GetAnnotations(), m.selector.MatchAnnotations)
+}
+
+// containsAll returns true if every key of want is set to the same value in
+// have.
+func containsAll(have, want map[string]string) bool {
+	for k, v := range want {
+		if h, ok := have[k]; !ok || h != v {
+			return false
+		}
+	}
+	return true
+}
+
+// composedObject returns the desired composed resource with the supplied name,
+// falling back to the observed one, or nil if neither exists.
+func composedObject(
+	name resource.Name,
+	desiredComposed map[resource.Name]*resource.DesiredComposed,
+	observedComposed map[resource.Name]resource.ObservedComposed,
+) *unstructured.Unstructured {
+	if d, ok := desiredComposed[name]; ok {
+		return &d.Resource.Unstructured
+	}
+	if o, ok := observedComposed[name]; ok {
+		return &o.Resource.Unstructured
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	xpv2 "github.com/crossplane/crossplane/apis/v2/core/v2"
+	"github.com/crossplane/function-sequencer/input/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	v1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+)
+
+// isReady returns true if the named composed resource is ready according to
+// the supplied readiness source.
+func isReady(
+	name resource.Name,
+	desiredComposed map[resource.Name]*resource.DesiredComposed,
+	observedComposed map[resource.Name]resource.ObservedComposed,
+	source v1beta1.ReadinessSource,
+) bool {
+	switch source {
+	case v1beta1.ReadinessSourceObserved:
+		return observedReady(name, observedComposed)
+	case v1beta1.ReadinessSourceBoth:
+		return desiredReady(name, desiredComposed) && observedReady(name, observedComposed)
+	case v1beta1.ReadinessSourceDesired:
+	}
+	return desiredReady(name, desiredComposed)
+}
+
+// desiredReady returns true if an earlier pipeline step marked the desired
+// composed resource as ready.
+func desiredReady(name resource.Name, desiredComposed map[resource.Name]*resource.DesiredComposed) bool {
+	d, ok := desiredComposed[name]
+	return ok && d.Ready == resource.ReadyTrue
+}
+
+// observedReady returns true if the observed composed resource reports a True
+// Ready condition and is not failing to sync.
+func observedReady(name resource.Name, observedComposed map[resource.Name]resource.ObservedComposed) bool {
+	o, ok := observedComposed[name]
+	if !ok {
+		return false
+	}
+	if o.Resource.GetCondition(xpv2.TypeReady).Status != corev1.ConditionTrue {
+		return false
+	}
+	return o.Resource.GetCondition(xpv2.TypeSynced).Status != corev1.ConditionFalse
+}
+
+// isStepReady returns true if the named composed resource is ready and
+// satisfies the readyWhen expression of the step it matched. The error policy
+// of the step applies when the expression cannot be evaluated.
+func (f *Function) isStepReady(
+	req *v1.RunFunctionRequest,
+	rsp *v1.RunFunctionResponse,
+	s step,
+	name resource.Name,
+	desiredComposed map[resource.Name]*resource.DesiredComposed,
+	observedComposed map[resource.Name]resource.ObservedComposed,
+	source v1beta1.ReadinessSource,
+) (bool, error) {
+	if !isReady(name, desiredComposed, observedComposed, source) {
+		return false, nil
+	}
+	if s.readyWhen == "" {
+		return true, nil
+	}
+	observed, ok := req.GetObserved().GetResources()[string(name)]
+	if !ok {
+		// The expression can only be satisfied by a resource that exists.
+		return false, nil
+	}
+	ready, err := f.evaluateCondition(req, source, s.readyWhen, observed.GetResource())
+	if err != nil {
+		return f.conditionFailed(rsp, s.onError, errors.Wrapf(err, "cannot evaluate readyWhen %q for resource %q", s.readyWhen, name))
+	}
+	return ready, nil
+}
+
+// requiredMatches returns how many desired resources must match the step.
+func (s step) requiredMatches() int {
+	if s.minMatches == nil {
+		return 1
+	}
+	return int(*s.minMatches)
+}
+
+// requiredReady returns how many of the resources matching a pattern of the
+// step must be ready. Percentages are scaled against the number of matches,
+// rounding up.
+func (s step) requiredReady(p pattern, matches int) (int, error) {
+	if s.minReady == nil {
+		return matches, nil
+	}
+	n, err := intstr.GetScaledValueFromIntOrPercent(s.minReady, matches, true)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid minReady for %q", p)
+	}
+	return n, nil
+}
+
+// soakRemaining returns how much longer the named resource must stay ready
+// before it has soaked for the duration required by the step. It soaks from
+// the lastTransitionTime of its observed True Ready condition or, when it has
+// none, for example because its readiness comes from the desired state, from
+// its creationTimestamp. A resource that has not been observed yet has not
+// started soaking.
+func (f *Function) soakRemaining(s step, name resource.Name, observedComposed map[resource.Name]resource.ObservedComposed) time.Duration {
+	if s.soakDuration == 0 {
+		return 0
+	}
+	o, ok := observedComposed[name]
+	if !ok {
+		return s.soakDuration
+	}
+	since := o.Resource.GetCreationTimestamp().Time
+	if c := o.Resource.GetCondition(xpv2.TypeReady); c.Status == corev1.ConditionTrue && !c.LastTransitionTime.IsZero() {
+		since = c.LastTransitionTime.Time
+	}
+	if since.IsZero() {
+		return s.soakDuration
+	}
+	return max(since.Add(s.soakDuration).Sub(f.now()), 0)
+}
+
+// waitingReason explains why the successors of a step cannot be created yet,
+// given how many resources match one of its patterns, how many of them are
+// ready and how many are ready but still soaking. It returns an empty string
+// when the pattern is satisfied.
+func (s step) waitingReason(p pattern, matches, ready, soaking int) (string, error) {
+	required, err := s.requiredReady(p, matches)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case matches < s.requiredMatches() && matches == 0:
+		return fmt.Sprintf("%q does not exist yet", p), nil
+	case matches < s.requiredMatches():
+		return fmt.Sprintf("only %d resource(s) match %q (%d required)", matches, p, s.requiredMatches()), nil
+	case ready >= required:
+		return "", nil
+	case soaking > 0 && ready+soaking >= required:
+		return fmt.Sprintf("%q has not been ready for %s yet", p, s.soakDuration), nil
+	case s.minReady == nil:
+		return fmt.Sprintf("%q is not fully ready (%d of %d)", p, ready, matches), nil
+	}
+	return fmt.Sprintf("%q is not sufficiently ready (%d of %d, %d required)", p, ready, matches, required), nil
+}
+
+// readiness counts the resources matching a pattern of a step that are ready
+// and those that are ready but still soaking.
+type readiness struct {
+	matches, ready, soaking int
+	// soakLeft is how long until the first resource still soaking has soaked.
+	soakLeft time.Duration
+}
+
+// countReady counts how many of the named resources matching a pattern of the
+// step are ready and how many are still soaking.
+func (f *Function) countReady(
+	req *v1.RunFunctionRequest,
+	rsp *v1.RunFunctionResponse,
+	s step,
+	names []resource.Name,
+	idx *matchIndex,
+	source v1beta1.ReadinessSource,
+) (readiness, error) {
+	r := readiness{matches: len(names)}
+	for _, k := range names {
+		ok, err := f.isStepReady(req, rsp, s, k, idx.desiredComposed, idx.observedComposed, source)
+		if err != nil {
+			return readiness{}, err
+		}
+		if !ok {
+			continue
+		}
+		if left := f.soakRemaining(s, k, idx.observedComposed); left > 0 {
+			r.soaking++
+			if r.soakLeft == 0 || left < r.soakLeft {
+				r.soakLeft = left
+			}
+			continue
+		}
+		r.ready++
+	}
+	return r, nil
+}
+
+// waitingOn explains why the successors of a step cannot be created yet, or
+// returns an empty string when every pattern of the step is satisfied. When
+// resources of the blocking pattern are still soaking, it also returns how
+// long until the first of them has soaked.
+func (f *Function) waitingOn(
+	req *v1.RunFunctionRequest,
+	rsp *v1.RunFunctionResponse,
+	s step,
+	idx *matchIndex,
+	source v1beta1.ReadinessSource,
+) (string, time.Duration, error) {
+	for _, p := range s.patterns {
+		names, err := idx.desired(p)
+		if err != nil {
+			return "", 0, err
+		}
+		// Count the desired resources matching the predecessor pattern that
+		// are ready and those still soaking.
+		r, err := f.countReady(req, rsp, s, names, idx, source)
+		if err != nil {
+			return "", 0, err
+		}
+		reason, err := s.waitingReason(p, r.matches, r.ready, r.soaking)
+		if err != nil {
+			return "", 0, err
+		}
+		if reason == "" {
+			continue
+		}
+		if s.stage != "" {
+			reason = fmt.Sprintf("%s is not ready: %s", s, reason)
+		}
+		return reason, r.soakLeft, nil
+	}
+	return "", 0, nil
+}
+
+// waitingSince returns when the step started blocking its successors: the
+// earliest lastTransitionTime of the Ready condition of the observed resources
+// matching it that are not ready, but never earlier than the supplied time the
+// step was unblocked. A step none of whose resources has been observed yet has
+// been waiting since it was unblocked.
+func (s step) waitingSince(idx *matchIndex, unblocked time.Time) (time.Time, error) {
+	var since time.Time
+	for _, p := range s.patterns {
+		names, err := idx.observed(p)
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, k := range names {
+			c := idx.observedComposed[k].Resource.GetCondition(xpv2.TypeReady)
+			if c.Status == corev1.ConditionTrue || c.LastTransitionTime.IsZero() {
+				continue
+			}
+			if since.IsZero() || c.LastTransitionTime.Time.Before(since) {
+				since = c.LastTransitionTime.Time
+			}
+		}
+	}
+	if since.Before(unblocked) {
+		return unblocked, nil
+	}
+	return since, nil
+}
+
+// unblockedAt returns when the step at index i could first be created: the
+// latest lastTransitionTime of the True Ready condition of the observed
+// resources matching its ancestors, or the supplied creation time of the
+// composite if none of them has been observed as ready yet.
+func (g *sequencingGraph) unblockedAt(i int, order []int, idx *matchIndex, created time.Time) (time.Time, error) {
+	unblocked := created
+	for _, a := range g.ancestors(i, order) {
+		for _, p := range g.steps[a].patterns {
+			names, err := idx.observed(p)
+			if err != nil {
+				return time.Time{}, err
+			}
+			for _, k := range names {
+				c := idx.observedComposed[k].Resource.GetCondition(xpv2.TypeReady)
+				if c.Status != corev1.ConditionTrue {
+					continue
+				}
+				if c.LastTransitionTime.After(unblocked) {
+					unblocked = c.LastTransitionTime.Time
+				}
+			}
+		}
+	}
+	return unblocked, nil
+}
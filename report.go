@@ -0,0 +1,130 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"github.com/crossplane/function-sequencer/input/v1beta1"
+
+	v1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composite"
+)
+
+// sequencingReport is the progress of every rule, written to the status of
+// the composite when a statusField is set.
+type sequencingReport struct {
+	Rules []ruleReport `json:"rules"`
+}
+
+// ruleReport is the progress of a sequencing rule.
+type ruleReport struct {
+	// Index of the rule. Rules inferred by the function or describing sync
+	// waves follow the rules of the input.
+	Index int    `json:"index"`
+	Name  string `json:"name,omitempty"`
+	// Skipped is true when the condition of the rule evaluated to false.
+	Skipped bool `json:"skipped,omitempty"`
+	// Stage is the position of the first step that is not ready in the
+	// order of the rule, or the number of steps once all of them are ready.
+	Stage int `json:"stage"`
+	// Steps is the number of steps of the rule, not counting bypassed steps.
+	Steps    int             `json:"steps"`
+	Patterns []patternReport `json:"patterns"`
+	// Blocked are the resources withheld from the desired state.
+	Blocked []string `json:"blocked,omitempty"`
+	// Usages are the names of the Usages generated for the rule.
+	Usages []string `json:"usages,omitempty"`
+}
+
+// patternReport is how many of the desired resources matching a pattern are
+// ready.
+type patternReport struct {
+	Pattern string `json:"pattern"`
+	Ready   int    `json:"ready"`
+	Total   int    `json:"total"`
+}
+
+// ruleProgress records what the function did for a rule.
+type ruleProgress struct {
+	// sequence is the graph of the rule without its bypassed steps.
+	sequence *sequencingGraph
+	order    []int
+	skipped  bool
+	// blocked are the resources the rule withheld from the desired state.
+	blocked []resource.Name
+	// usages are the Usages generated for the rule.
+	usages map[resource.Name]*resource.DesiredComposed
+}
+
+// reportRule reports the progress of a rule. Resources withheld by any rule
+// count towards the total of the patterns they match, but are never ready.
+func (f *Function) reportRule(
+	req *v1.RunFunctionRequest,
+	rsp *v1.RunFunctionResponse,
+	index int,
+	rule v1beta1.SequencingRule,
+	progress ruleProgress,
+	idx *matchIndex,
+	source v1beta1.ReadinessSource,
+) (ruleReport, error) {
+	order := progress.order
+	r := ruleReport{Index: index, Name: rule.Name, Skipped: progress.skipped, Stage: len(order), Steps: len(order), Patterns: []patternReport{}}
+	for pos, i := range order {
+		s := progress.sequence.steps[i]
+		for _, p := range s.patterns {
+			names, err := idx.matched(p)
+			if err != nil {
+				return ruleReport{}, err
+			}
+			c, err := f.countReady(req, rsp, s, names, idx, source)
+			if err != nil {
+				return ruleReport{}, err
+			}
+			r.Patterns = append(r.Patterns, patternReport{Pattern: p.String(), Ready: c.ready, Total: c.matches})
+			reason, err := s.waitingReason(p, c.matches, c.ready, c.soaking)
+			if err != nil {
+				return ruleReport{}, err
+			}
+			if reason != "" && r.Stage == len(order) {
+				r.Stage = pos
+			}
+		}
+	}
+	for _, n := range progress.blocked {
+		r.Blocked = append(r.Blocked, string(n))
+	}
+	for _, u := range progress.usages {
+		r.Usages = append(r.Usages, u.Resource.GetName())
+	}
+	slices.Sort(r.Usages)
+	return r, nil
+}
+
+// setStatusField writes the report to a field of the status of the desired
+// composite, e.g. status.sequencer.
+func setStatusField(rsp *v1.RunFunctionResponse, field string, report sequencingReport) error {
+	xr := composite.New()
+	if err := resource.AsObject(rsp.GetDesired().GetComposite().GetResource(), xr); err != nil {
+		return errors.Wrap(err, "cannot get desired composite resource")
+	}
+	v := map[string]any{}
+	if err := convertViaJSON(&v, report); err != nil {
+		return errors.Wrap(err, "cannot convert sequencing report")
+	}
+	if err := xr.SetValue(field, v); err != nil {
+		return errors.Wrapf(err, "cannot set statusField %q", field)
+	}
+	s, err := resource.AsStruct(xr)
+	if err != nil {
+		return errors.Wrap(err, "cannot convert desired composite resource")
+	}
+	if rsp.GetDesired() == nil {
+		rsp.Desired = &v1.State{}
+	}
+	if rsp.GetDesired().GetComposite() == nil {
+		rsp.Desired.Composite = &v1.Resource{}
+	}
+	rsp.Desired.Composite.Resource = s
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/crossplane/function-sequencer/input/v1beta1"
+
+	v1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// defaultMaxNames is how many resource names a summary lists for each
+// predecessor unless configured otherwise.
+const defaultMaxNames = 10
+
+// summarizeDelays reports the resources a rule withholds as a single result,
+// grouping them by what they are waiting on.
+func summarizeDelays(rsp *v1.RunFunctionResponse, sequence *sequencingGraph, cfg *v1beta1.Results, blocked []blockedResources) {
+	waiting := []string{}
+	names := map[string][]resource.Name{}
+	for _, b := range blocked {
+		if !b.summarize {
+			continue
+		}
+		if _, ok := names[b.waiting]; !ok {
+			waiting = append(waiting, b.waiting)
+		}
+		for _, n := range b.names {
+			if !slices.Contains(names[b.waiting], n) {
+				names[b.waiting] = append(names[b.waiting], n)
+			}
+		}
+	}
+	if len(waiting) == 0 {
+		return
+	}
+	limit := maxNames(cfg)
+	groups := make([]string, len(waiting))
+	for i, w := range waiting {
+		groups[i] = fmt.Sprintf("%d resource(s) waiting because %s", len(names[w]), w)
+		if cfg.Verbosity == v1beta1.ResultVerbosityCount || limit == 0 {
+			continue
+		}
+		groups[i] = fmt.Sprintf("%s: %s", groups[i], listNames(names[w], limit))
+	}
+	response.Normal(rsp, fmt.Sprintf("Delaying creation in sequence %v: %s", sequence, strings.Join(groups, "; ")))
+}
+
+// maxNames returns how many resource names are listed for each predecessor.
+func maxNames(cfg *v1beta1.Results) int {
+	if cfg == nil || cfg.MaxNames == nil {
+		return defaultMaxNames
+	}
+	return int(*cfg.MaxNames)
+}
+
+// listNames lists at most maxNames of the names, followed by how many more
+// there are.
+func listNames(names []resource.Name, maxNames int) string {
+	listed := make([]string, 0, maxNames)
+	for _, n := range names[:min(maxNames, len(names))] {
+		listed = append(listed, string(n))
+	}
+	more := len(names) - len(listed)
+	switch {
+	case more == 0:
+		return strings.Join(listed, ", ")
+	case len(listed) == 0:
+		return fmt.Sprintf("%d resource(s)", more)
+	default:
+		return fmt.Sprintf("%s and %d more", strings.Join(listed, ", "), more)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"github.com/crossplane/function-sequencer/input/v1beta1"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	v1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// sequencingState is the sequencing plan and the resources withheld from the
+// desired state, published to the pipeline context for later functions.
+type sequencingState struct {
+	Rules []ruleState `json:"rules"`
+	// Blocked are the resources withheld from the desired state by any rule.
+	Blocked []string `json:"blocked"`
+}
+
+// ruleState is the plan of a rule and what it did to the desired composed
+// resources matching its steps.
+type ruleState struct {
+	Index int    `json:"index"`
+	Name  string `json:"name,omitempty"`
+	// Steps are the patterns of each step of the rule, in the order they are
+	// created, not counting bypassed steps.
+	Steps [][]string `json:"steps"`
+	// Released are the resources the rule left in the desired state.
+	Released []string `json:"released"`
+	// Blocked are the resources the rule withheld from the desired state.
+	Blocked []string `json:"blocked"`
+	// Skipped are the resources the rule did not sequence, because its
+	// condition is false or they only match bypassed steps.
+	Skipped []string `json:"skipped"`
+}
+
+// newRuleState describes what the function did for a rule, given the graph of
+// the rule before any of its steps were bypassed.
+func newRuleState(index int, rule v1beta1.SequencingRule, all *sequencingGraph, progress ruleProgress, idx *matchIndex) (ruleState, error) {
+	s := ruleState{Index: index, Name: rule.Name, Steps: [][]string{}, Released: []string{}, Blocked: []string{}, Skipped: []string{}}
+	for _, i := range progress.order {
+		patterns := []string{}
+		for _, p := range progress.sequence.steps[i].patterns {
+			patterns = append(patterns, p.String())
+		}
+		s.Steps = append(s.Steps, patterns)
+	}
+	sequenced, err := idx.matchedBy(progress.sequence)
+	if err != nil {
+		return ruleState{}, err
+	}
+	matched, err := idx.matchedBy(all)
+	if err != nil {
+		return ruleState{}, err
+	}
+	for _, n := range slices.Sorted(maps.Keys(matched)) {
+		switch {
+		case progress.skipped || !sequenced[n]:
+			s.Skipped = append(s.Skipped, string(n))
+		case slices.Contains(progress.blocked, n):
+			s.Blocked = append(s.Blocked, string(n))
+		default:
+			s.Released = append(s.Released, string(n))
+		}
+	}
+	return s, nil
+}
+
+// String describes the rule in result messages.
+func (s ruleState) String() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	patterns := []string{}
+	for _, step := range s.Steps {
+		patterns = append(patterns, step...)
+	}
+	return fmt.Sprintf("%v", patterns)
+}
+
+// setStateContextKey publishes the sequencing state to the pipeline context.
+func setStateContextKey(rsp *v1.RunFunctionResponse, state sequencingState) error {
+	v := map[string]any{}
+	if err := convertViaJSON(&v, state); err != nil {
+		return errors.Wrap(err, "cannot convert sequencing state")
+	}
+	s, err := structpb.NewValue(v)
+	if err != nil {
+		return errors.Wrap(err, "cannot convert sequencing state")
+	}
+	response.SetContextKey(rsp, StateContextKey, s)
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/crossplane/crossplane-runtime/v2/pkg/errors"
+	"github.com/crossplane/function-sequencer/input/v1beta1"
+
+	"github.com/crossplane/function-sdk-go/resource"
+)
+
+// syncWaves assigns every desired composed resource to a sync wave, read from
+// the wave annotation of the resource or else from the first wave of the input
+// whose patterns match its name. Resources without a wave are in wave 0. Usage
+// objects are never assigned a wave. It returns the resources of each wave
+// keyed by wave, or nil if no resource was assigned a wave.
+func syncWaves(waves []v1beta1.SyncWave, desiredComposed map[resource.Name]*resource.DesiredComposed) (map[int][]resource.Name, error) {
+	type compiled struct {
+		wave int
+		res  []*regexp.Regexp
+	}
+	mapping := make([]compiled, len(waves))
+	for i, w := range waves {
+		mapping[i].wave = int(w.Wave)
+		for _, p := range w.Resources {
+			re, err := getStrictRegex(string(p))
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot compile regex %s", p)
+			}
+			mapping[i].res = append(mapping[i].res, re)
+		}
+	}
+
+	assigned := false
+	byWave := map[int][]resource.Name{}
+	for _, name := range slices.Sorted(maps.Keys(desiredComposed)) {
+		if isUsageObject(&desiredComposed[name].Resource.Unstructured) {
+			continue
+		}
+		wave := 0
+		if v, ok := desiredComposed[name].Resource.GetAnnotations()[WaveAnnotation]; ok {
+			w, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid %s annotation on resource %q", WaveAnnotation, name)
+			}
+			wave, assigned = w, true
+		} else {
+			for _, m := range mapping {
+				if slices.ContainsFunc(m.res, func(re *regexp.Regexp) bool { return re.MatchString(string(name)) }) {
+					wave, assigned = m.wave, true
+					break
+				}
+			}
+		}
+		byWave[wave] = append(byWave[wave], name)
+	}
+	if !assigned {
+		return nil, nil
+	}
+	return byWave, nil
+}
+
+// newWaveGraph builds a chain of stages, one per sync wave in ascending order,
+// so that no resource is created until every resource in the waves before it
+// is ready.
+func newWaveGraph(byWave map[int][]resource.Name) (*sequencingGraph, error) {
+	waves := slices.Sorted(maps.Keys(byWave))
+	steps := make([]v1beta1.SequenceStep, len(waves))
+	for i, w := range waves {
+		for _, name := range byWave[w] {
+			steps[i].Resources = append(steps[i].Resources, resource.Name(regexp.QuoteMeta(string(name))))
+		}
+	}
+	g, err := newSequencingGraph(v1beta1.SequencingRule{Steps: steps})
+	if err != nil {
+		return nil, err
+	}
+	for i, w := range waves {
+		g.steps[i].stage = fmt.Sprintf("wave %d", w)
+	}
+	g.desc = fmt.Sprintf("sync waves %v", waves)
+	return g, nil
+}